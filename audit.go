@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// One mutating request, as written to the audit file.
+type AuditRecord struct {
+	Time      time.Time  `json:"time"`
+	Action    string     `json:"action"`
+	Identity  string     `json:"identity"`
+	SessionId *uuid.UUID `json:"session_id"`
+	Status    int        `json:"status"`
+	RequestId string     `json:"request_id"`
+}
+
+type auditRecordKey struct{}
+
+// Appends AuditRecords to a file as JSON lines, syncing each one before the request completes.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{file: file}, nil
+}
+
+func (a *AuditLog) Record(record AuditRecord) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+
+	return a.file.Sync()
+}
+
+// Names the session a request acted on in its audit record, for handlers that take the id from the body or create it.
+// Does nothing without an audit log.
+func AuditSession(r *http.Request, id uuid.UUID) {
+	if record, ok := r.Context().Value(auditRecordKey{}).(*AuditRecord); ok {
+		record.SessionId = &id
+	}
+}
+
+// Writes an audit record for each request to MutatingPaths, after next has handled it. Must be inside WithRequestId.
+func WithAudit(next http.Handler, audit *AuditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !MutatingPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := &AuditRecord{
+			Time:      time.Now(),
+			Action:    strings.TrimPrefix(r.URL.Path, "/"),
+			Identity:  ClientIdentity(r),
+			RequestId: RequestId(r),
+		}
+		if id, err := uuid.Parse(r.URL.Query().Get("id")); err == nil {
+			record.SessionId = &id
+		}
+		recorder := &StatusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, record)))
+		record.Status = recorder.Status
+		if err := audit.Record(*record); err != nil {
+			log.Printf("Could not write audit record for %s request_id=%s: %s", record.Action, record.RequestId, err.Error())
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditCreateAndClose(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	s := startServer(t, "-audit-file", auditFile)
+	s.get(t, "/list-sessions")
+	res, read := s.post(t, "/create-session", `{"name":"audited"}`, ClientIdHeader, "alice")
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %d %s", res.StatusCode, read)
+	}
+	var session Session
+	decode(t, read, &session)
+	if res, read := s.post(t, "/close-session", fmt.Sprintf(`{"id":%q}`, session.Id.String()), ClientIdHeader, "alice"); res.StatusCode != http.StatusOK {
+		t.Fatalf("close: %d %s", res.StatusCode, read)
+	}
+
+	lines := readLines(t, auditFile)
+	if len(lines) != 2 {
+		t.Fatalf("got %q", lines)
+	}
+	for i, action := range []string{"create-session", "close-session"} {
+		var record AuditRecord
+		decode(t, lines[i], &record)
+		if record.Action != action || record.Identity != "alice" || record.Status != http.StatusOK || record.RequestId == "" {
+			t.Errorf("record %d: got %+v", i, record)
+		}
+		if record.SessionId == nil || *record.SessionId != session.Id {
+			t.Errorf("record %d: got session %v, want %s", i, record.SessionId, session.Id)
+		}
+		if record.Time.IsZero() {
+			t.Errorf("record %d: no time", i)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"os"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	CharsetUTF8    = "utf8"
+	CharsetUTF16LE = "utf16le"
+)
+
+// Charsets a session's file can be written in.
+var Charsets = []string{CharsetUTF8, CharsetUTF16LE}
+
+// Names of the charsets in a Content-Type header.
+var MIMECharsets = map[string]string{
+	CharsetUTF8:    "utf-8",
+	CharsetUTF16LE: "utf-16le",
+}
+
+// Byte order mark written at the start of a utf16le file.
+var UTF16LEBOM = []byte{0xFF, 0xFE}
+
+// Encodes a line in charset, prefixed with the charset's byte order mark when the file at path is missing or empty.
+func EncodeLine(line string, charset string, path string) string {
+	if charset != CharsetUTF16LE {
+		return line
+	}
+
+	units := utf16.Encode([]rune(line))
+	encoded := make([]byte, 0, len(UTF16LEBOM)+2*len(units))
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		encoded = append(encoded, UTF16LEBOM...)
+	}
+	for _, unit := range units {
+		encoded = append(encoded, byte(unit), byte(unit>>8))
+	}
+
+	return string(encoded)
+}
+
+// Reports whether name is one of Charsets.
+func IsCharset(name string) bool {
+	for _, charset := range Charsets {
+		if charset == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads a utf16le stream as UTF-8, dropping byte order marks. Each shard of a sharded session starts with its own.
+type UTF16LEReader struct {
+	source io.ReadCloser
+	// Bytes read from source but not yet decoded: an odd byte or a high surrogate waiting for the rest of its pair
+	pending []byte
+	decoded []byte
+	err     error
+}
+
+func NewUTF16LEReader(source io.ReadCloser) *UTF16LEReader {
+	return &UTF16LEReader{source: source}
+}
+
+func (u *UTF16LEReader) Read(p []byte) (int, error) {
+	for len(u.decoded) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		chunk := make([]byte, 4096)
+		n, err := u.source.Read(chunk)
+		u.pending = append(u.pending, chunk[:n]...)
+		u.err = err
+		u.decode(err != nil)
+	}
+	n := copy(p, u.decoded)
+	u.decoded = u.decoded[n:]
+
+	return n, nil
+}
+
+// Decodes the complete code units in pending. At the end of the stream whatever is left is decoded too, as U+FFFD.
+func (u *UTF16LEReader) decode(end bool) {
+	units := make([]uint16, 0, len(u.pending)/2)
+	for i := 0; i+1 < len(u.pending); i += 2 {
+		units = append(units, uint16(u.pending[i])|uint16(u.pending[i+1])<<8)
+	}
+	used := 2 * len(units)
+	if !end && len(units) > 0 && utf16.IsSurrogate(rune(units[len(units)-1])) && units[len(units)-1] < 0xDC00 {
+		units = units[:len(units)-1]
+		used -= 2
+	}
+	for _, r := range utf16.Decode(units) {
+		if r != 0xFEFF {
+			u.decoded = utf8.AppendRune(u.decoded, r)
+		}
+	}
+	u.pending = u.pending[used:]
+	if end && len(u.pending) > 0 {
+		u.decoded = utf8.AppendRune(u.decoded, utf8.RuneError)
+		u.pending = nil
+	}
+}
+
+func (u *UTF16LEReader) Close() error {
+	return u.source.Close()
+}
+
+// Opens a session's log for reading as UTF-8, whatever charset it was written in.
+func OpenSessionText(session Session) (io.ReadCloser, error) {
+	file, err := OpenSessionLog(session)
+	if err != nil || session.Charset != CharsetUTF16LE {
+		return file, err
+	}
+
+	return NewUTF16LEReader(file), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf16"
+)
+
+// Decodes utf16le bytes without a byte order mark.
+func decodeUTF16LE(data []byte) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func TestEncodeLineUTF16LE(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wide")
+	first := EncodeLine("hé\n", CharsetUTF16LE, path)
+	if want := "\xff\xfeh\x00\xe9\x00\n\x00"; first != want {
+		t.Errorf("first line: got %q, want %q", first, want)
+	}
+	os.WriteFile(path, []byte(first), 0644)
+	if second := EncodeLine("😀\n", CharsetUTF16LE, path); decodeUTF16LE([]byte(second)) != "😀\n" || len(second) != 6 {
+		t.Errorf("second line: got %q", second)
+	}
+	if line := EncodeLine("hé\n", CharsetUTF8, path); line != "hé\n" {
+		t.Errorf("utf8: got %q", line)
+	}
+}
+
+func TestUTF16LESession(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"wide","charset":"utf16le"}`)
+	s.write(t, session.Id, "héllo")
+	s.write(t, session.Id, "wörld")
+
+	data, err := os.ReadFile(s.path(session))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, UTF16LEBOM) || bytes.Count(data, UTF16LEBOM) != 1 {
+		t.Fatalf("got %q", data)
+	}
+	lines := strings.Split(strings.TrimSuffix(decodeUTF16LE(data[len(UTF16LEBOM):]), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "Log: héllo") || !strings.HasSuffix(lines[1], "Log: wörld") {
+		t.Errorf("got %q", lines)
+	}
+
+	if res, read := s.post(t, "/create-session", `{"name":"bad","charset":"latin1"}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown charset: got %d %s", res.StatusCode, read)
+	}
+}
+
+func TestUTF16LEReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wide")
+	encoded := EncodeLine("hé 😀\n", CharsetUTF16LE, path)
+	// A second shard starts with its own byte order mark
+	encoded += EncodeLine("second\n", CharsetUTF16LE, path)
+	// Read a byte at a time, so code units and surrogate pairs are split across reads
+	decoded, err := io.ReadAll(NewUTF16LEReader(io.NopCloser(iotest.OneByteReader(strings.NewReader(encoded)))))
+	if err != nil || string(decoded) != "hé 😀\nsecond\n" {
+		t.Errorf("got %q, %v", decoded, err)
+	}
+
+	truncated, _ := io.ReadAll(NewUTF16LEReader(io.NopCloser(strings.NewReader("h\x00\x3d\xd8\x00"))))
+	if string(truncated) != "h\uFFFD\uFFFD" {
+		t.Errorf("truncated: got %q", truncated)
+	}
+}
+
+func TestUTF16LESessionsReadBackAsUTF8(t *testing.T) {
+	s := startServer(t)
+	wide := s.create(t, `{"name":"wide","charset":"utf16le"}`)
+	narrow := s.create(t, `{"name":"narrow"}`)
+	for i, write := range []struct {
+		session Session
+		content string
+	}{{wide, "wïde one"}, {narrow, "narrow two"}, {wide, "wïde three"}} {
+		body := fmt.Sprintf(`{"id":%q,"content":%q,"timestamp":"2026-10-14T00:00:0%dZ"}`, write.session.Id, write.content, i+1)
+		if res, read := s.post(t, "/write-session", body); res.StatusCode != http.StatusOK {
+			t.Fatalf("write: %d %s", res.StatusCode, read)
+		}
+	}
+
+	_, read := s.get(t, "/logs")
+	lines := strings.Split(strings.TrimSuffix(read, "\n"), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "[wide] ") || !strings.HasSuffix(lines[0], "Log: wïde one") ||
+		!strings.HasSuffix(lines[1], "Log: narrow two") || !strings.HasSuffix(lines[2], "Log: wïde three") {
+		t.Errorf("/logs: got %q", read)
+	}
+
+	_, read = s.get(t, "/read-sessions?id="+wide.Id.String())
+	var contents map[string]struct{ Content string }
+	decode(t, read, &contents)
+	if content := contents[wide.Id.String()].Content; strings.ContainsAny(content, "\x00\uFEFF\uFFFD") || !strings.Contains(content, "Log: wïde three\n") {
+		t.Errorf("/read-sessions: got %q", content)
+	}
+
+	target := s.create(t, `{"name":"target"}`)
+	if res, read := s.post(t, "/replay", fmt.Sprintf(`{"source_id":%q,"target_id":%q}`, wide.Id, target.Id)); res.StatusCode != http.StatusOK {
+		t.Fatalf("replay: %d %s", res.StatusCode, read)
+	}
+	if replayed := readLines(t, s.path(target)); len(replayed) != 2 || !strings.HasSuffix(replayed[1], "Log: wïde three") {
+		t.Errorf("replay: got %q", replayed)
+	}
+
+	wideJSON := s.create(t, `{"name":"wide json","format":"json","charset":"utf16le"}`)
+	s.write(t, wideJSON.Id, "wïde json")
+	_, read = s.get(t, "/read-session?as=array&id="+wideJSON.Id.String())
+	var array []struct{ Content string }
+	decode(t, read, &array)
+	if len(array) != 1 || array[0].Content != "wïde json" {
+		t.Errorf("as=array: got %s", read)
+	}
+
+	s.close(t, wide.Id)
+	if res, read := s.post(t, "/compact-session?id="+wide.Id.String(), ""); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("compact: got %d %s", res.StatusCode, read)
+	}
+}
+
+func TestUTF16LESessionSinceLines(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"wide","charset":"utf16le"}`)
+	for _, content := range []string{"ëins", "zwëi", "drëi"} {
+		s.write(t, session.Id, content)
+	}
+
+	_, read := s.get(t, "/session-since?lines=true&seq=1&id="+session.Id.String())
+	var since SessionSince
+	decode(t, read, &since)
+	if since.Count != 2 || len(since.Lines) != 2 || !strings.HasSuffix(since.Lines[0], "Log: zwëi") || !strings.HasSuffix(since.Lines[1], "Log: drëi") {
+		t.Errorf("got %s", read)
+	}
+}
+
+func TestUTF16LEReadFromRejected(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"wide","charset":"utf16le"}`)
+	s.write(t, session.Id, "hello")
+
+	if res, read := s.get(t, "/read-session?from=hello&id="+session.Id.String()); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d %s", res.StatusCode, read)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const ChecksumField = "checksum"
+
+// Algorithms accepted by -line-checksum.
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"sha256": sha256.New,
+}
+
+// Matches the ' #<algorithm>:<hex>' suffix added to text lines, which may span several lines.
+var TextChecksumPattern = regexp.MustCompile(`(?s)^(.*) #([a-z0-9]+):([0-9a-f]+)$`)
+
+type ChecksumMismatch struct {
+	Line    int    `json:"line"`
+	Content string `json:"content"`
+}
+
+type VerifyResult struct {
+	Checked    int                `json:"checked"`
+	Unverified int                `json:"unverified"`
+	Mismatches []ChecksumMismatch `json:"mismatches"`
+}
+
+// Returns '<algorithm>:<hex digest>' of data.
+func Checksum(algorithm string, data []byte) (string, error) {
+	newHash, ok := ChecksumAlgorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+	h := newHash()
+	h.Write(data)
+
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Adds a checksum of the line to it. Text lines get a ' #<algorithm>:<hex>' suffix, json lines a checksum field.
+func AddChecksum(line string, format string, algorithm string) (string, error) {
+	body := strings.TrimSuffix(line, "\n")
+	if format != FormatJSON {
+		sum, err := Checksum(algorithm, []byte(body))
+		if err != nil {
+			return "", err
+		}
+		return body + " #" + sum + "\n", nil
+	}
+
+	// Sum the re-encoded object, which is what verification reproduces
+	object, err := decodeJSONObject(body)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+	if object[ChecksumField], err = Checksum(algorithm, encoded); err != nil {
+		return "", err
+	}
+	if encoded, err = json.Marshal(object); err != nil {
+		return "", err
+	}
+
+	return string(encoded) + "\n", nil
+}
+
+// Recomputes a line's checksum. checked is false if the line doesn't carry one.
+func VerifyLine(line string, format string) (checked bool, valid bool) {
+	var body, sum string
+	if format != FormatJSON {
+		match := TextChecksumPattern.FindStringSubmatch(line)
+		if match == nil {
+			return false, false
+		}
+		body, sum = match[1], match[2]+":"+match[3]
+	} else {
+		object, err := decodeJSONObject(line)
+		if err != nil {
+			return false, false
+		}
+		if sum, checked = object[ChecksumField].(string); !checked {
+			return false, false
+		}
+		delete(object, ChecksumField)
+		encoded, err := json.Marshal(object)
+		if err != nil {
+			return true, false
+		}
+		body = string(encoded)
+	}
+
+	algorithm, _, _ := strings.Cut(sum, ":")
+	expected, err := Checksum(algorithm, []byte(body))
+
+	return true, err == nil && expected == sum
+}
+
+// Verifies every line read from r, reporting those whose checksum doesn't match. Text content spanning several lines
+// carries one checksum, on its last line, so lines without one are held back and verified together with the next line
+// that has one. Any of them that don't belong to it are counted as unverified.
+func VerifyLines(r io.Reader, format string) (VerifyResult, error) {
+	result := VerifyResult{Mismatches: []ChecksumMismatch{}}
+	var pending []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxStreamLineBytes)
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		checked, valid := VerifyLine(line, format)
+		if !checked {
+			if format == FormatJSON {
+				result.Unverified++
+			} else {
+				pending = append(pending, line)
+			}
+			continue
+		}
+		// Try the fewest preceding lines first, the checked line on its own
+		for start := len(pending); !valid && start > 0; start-- {
+			joined := strings.Join(append(append([]string(nil), pending[start-1:]...), line), "\n")
+			if _, valid = VerifyLine(joined, format); valid {
+				pending = pending[:start-1]
+			}
+		}
+		result.Unverified += len(pending)
+		pending = pending[:0]
+		result.Checked++
+		if !valid {
+			result.Mismatches = append(result.Mismatches, ChecksumMismatch{number, line})
+		}
+	}
+	result.Unverified += len(pending)
+
+	return result, scanner.Err()
+}
+
+// Decodes a json line keeping numbers as written, so re-encoding reproduces the original bytes.
+func decodeJSONObject(line string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
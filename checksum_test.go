@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAddChecksumVerifies(t *testing.T) {
+	for _, format := range []string{FormatText, FormatJSON} {
+		for algorithm := range ChecksumAlgorithms {
+			line := "2026-10-14T00:00:00Z [1] Log: hello\n"
+			if format == FormatJSON {
+				line = `{"content":"hello","seq":1,"n":1.50}` + "\n"
+			}
+			summed, err := AddChecksum(line, format, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checked, valid := VerifyLine(strings.TrimSuffix(summed, "\n"), format); !checked || !valid {
+				t.Errorf("%s %s: %q checked %v valid %v", format, algorithm, summed, checked, valid)
+			}
+			if _, valid := VerifyLine(strings.Replace(summed, "hello", "hellO", 1), format); valid {
+				t.Errorf("%s %s: altered line verified", format, algorithm)
+			}
+		}
+	}
+}
+
+func TestVerifyLinesMultiLineContent(t *testing.T) {
+	first, _ := AddChecksum("2026-10-14T00:00:00Z [1] Log: x\ny\nz\n", FormatText, "crc32")
+	second, _ := AddChecksum("2026-10-14T00:00:01Z [2] Log: single\n", FormatText, "crc32")
+	result, err := VerifyLines(strings.NewReader("unsummed\n"+first+second), FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 2 || result.Unverified != 1 || len(result.Mismatches) != 0 {
+		t.Errorf("got %+v", result)
+	}
+}
+
+func TestReadSessionVerifyFlagsCorruption(t *testing.T) {
+	s := startServer(t, "-line-checksum", "crc32")
+	session := s.create(t, `{"name":"sums"}`)
+	s.write(t, session.Id, "first")
+	s.write(t, session.Id, "x\ny")
+	s.write(t, session.Id, "third")
+
+	var result VerifyResult
+	_, read := s.get(t, "/read-session?verify=true&id="+session.Id.String())
+	decode(t, read, &result)
+	if result.Checked != 3 || len(result.Mismatches) != 0 {
+		t.Fatalf("untouched file: got %+v", result)
+	}
+
+	data, err := os.ReadFile(s.path(session))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.path(session), []byte(strings.Replace(string(data), "third", "THIRD", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, read = s.get(t, "/read-session?verify=true&id="+session.Id.String())
+	decode(t, read, &result)
+	if len(result.Mismatches) != 1 || result.Mismatches[0].Line != 4 {
+		t.Errorf("corrupted file: got %+v", result)
+	}
+}
+
+func TestReadSessionVerifyRejectsUTF16(t *testing.T) {
+	s := startServer(t, "-line-checksum", "crc32")
+	session := s.create(t, `{"name":"wide","charset":"utf16le"}`)
+	s.write(t, session.Id, "hello")
+
+	if res, read := s.get(t, "/read-session?verify=true&id="+session.Id.String()); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d %s", res.StatusCode, read)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Flags that are re-read on SIGHUP. Only flags read exclusively by the session manager may be listed here.
+var ReloadableFlags = map[string]bool{
+	"max-per-name":  true,
+	"error-history": true,
+}
+
+const EnvPrefix = "SESH_"
+
+// Returns the environment variable backing a flag, e.g. SESH_MAX_PER_NAME for -max-per-name.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Reads SESH_ settings from the environment, overlaid with the KEY=VALUE lines of the file at path if set.
+func ReadEnv(path string) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if key, value, found := strings.Cut(entry, "="); found && strings.HasPrefix(key, EnvPrefix) {
+			env[key] = value
+		}
+	}
+	if path == "" {
+		return env, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, found := strings.Cut(line, "="); found {
+			env[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return env, scanner.Err()
+}
+
+// Returns the names of flags given on the command line. These always take precedence over the environment.
+func ExplicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	return explicit
+}
+
+// Sets every flag not given on the command line from env.
+func ApplyEnv(env map[string]string, explicit map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := env[EnvName(f.Name)]; ok && !explicit[f.Name] && err == nil {
+			err = flag.Set(f.Name, value)
+		}
+	})
+
+	return err
+}
+
+// Returns the names of numeric flags set to a negative value. No flag has a meaning for negative numbers.
+func NegativeFlags() []string {
+	var negative []string
+	flag.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		switch value := getter.Get().(type) {
+		case int:
+			ok = value >= 0
+		case int64:
+			ok = value >= 0
+		case float64:
+			ok = value >= 0
+		case time.Duration:
+			ok = value >= 0
+		}
+		if !ok {
+			negative = append(negative, "-"+f.Name)
+		}
+	})
+
+	return negative
+}
+
+// Describes every flag that differs from its default as '-name=value', with secrets redacted.
+func ConfigSummary() []string {
+	var summary []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == f.DefValue {
+			return
+		}
+		value := f.Value.String()
+		if SecretFlags[f.Name] {
+			value = Redacted
+		}
+		summary = append(summary, fmt.Sprintf("-%s=%s", f.Name, value))
+	})
+
+	return summary
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("max-per-name"); got != "SESH_MAX_PER_NAME" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sesh.env")
+	os.WriteFile(path, []byte("# limits\nSESH_MAX_PER_NAME = 3\n\nSESH_ERROR_HISTORY=5\n"), 0644)
+	env, err := ReadEnv(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["SESH_MAX_PER_NAME"] != "3" || env["SESH_ERROR_HISTORY"] != "5" {
+		t.Errorf("got %v", env)
+	}
+}
+
+func TestReloadOnSighup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sesh.env")
+	os.WriteFile(path, []byte("SESH_MAX_PER_NAME=0\n"), 0644)
+	s := startServer(t, "-env-file", path)
+	s.create(t, `{"name":"reloaded"}`)
+	s.create(t, `{"name":"reloaded"}`)
+
+	os.WriteFile(path, []byte("SESH_MAX_PER_NAME=2\nSESH_PRETTY=true\n"), 0644)
+	s.cmd.Process.Signal(syscall.SIGHUP)
+	eventually(t, 5*time.Second, func() bool {
+		return strings.Contains(s.stdout.String(), "Reloaded -max-per-name=2") && strings.Contains(s.stderr.String(), "Ignoring change to SESH_PRETTY")
+	})
+	if res, read := s.post(t, "/create-session", `{"name":"reloaded"}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("after reload: got %d %s", res.StatusCode, read)
+	}
+	if _, read := s.get(t, "/list-sessions"); strings.Contains(read, "\n  ") {
+		t.Errorf("-pretty was reloaded: %s", read)
+	}
+}
+
+func TestInvalidFlagsExit(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		message string
+	}{
+		{[]string{"-max-per-name", "-1"}, "-max-per-name can't be negative"},
+		{[]string{"-tls-cert", "cert.pem"}, "-tls-cert and -tls-key must be set together"},
+		{[]string{"-line-template", "{{.Nope}}"}, "-line-template: template"},
+		{[]string{"-retention", "1h", "-sweep-interval", "0"}, "-sweep-interval must be positive"},
+		{[]string{"-auto-name", "-default-name", "x"}, "can't be used together"},
+		{[]string{"-rollover", "fortnightly"}, "Invalid -rollover"},
+		{[]string{"-syslog-addr", "127.0.0.1:514", "-syslog-network", "bogus"}, "-syslog-network must be udp or tcp"},
+		{[]string{"-syslog-addr", "localhost"}, "-syslog-addr: "},
+	} {
+		if output := startFailing(t, test.args...); !strings.Contains(output, test.message) {
+			t.Errorf("%v: got %s", test.args, output)
+		}
+	}
+}
+
+func TestStartupSummary(t *testing.T) {
+	s := startServer(t, "-max-per-name", "3", "-hmac-secret", "hunter2")
+	eventually(t, 5*time.Second, func() bool { return strings.Contains(s.stdout.String(), "-max-per-name=3") })
+	if stdout := s.stdout.String(); !strings.Contains(stdout, "-hmac-secret="+Redacted) || strings.Contains(stdout, "hunter2") {
+		t.Errorf("got %s", stdout)
+	}
+}
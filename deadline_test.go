@@ -0,0 +1,87 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A FIFO in place of a session's file blocks writes to it until something reads from it.
+func TestWriteDeadlineAbandonsStalledWrite(t *testing.T) {
+	s := startServer(t, "-write-deadline", "100ms")
+	session := s.create(t, `{"name":"stalled"}`)
+	path := s.path(session)
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(content string) (int, string) {
+		res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":%q}`, session.Id, content))
+		return res.StatusCode, read
+	}
+	if status, read := write("first"); status != http.StatusGatewayTimeout {
+		t.Fatalf("stalled write: got %d %s", status, read)
+	}
+	if status, read := write("second"); status != http.StatusServiceUnavailable {
+		t.Fatalf("write behind the stalled one: got %d %s", status, read)
+	}
+
+	fifo, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, _ := io.ReadAll(fifo)
+	fifo.Close()
+	os.Remove(path)
+	if !strings.HasSuffix(string(abandoned), "[1] Log: first\n") {
+		t.Fatalf("abandoned write: got %q", abandoned)
+	}
+
+	eventually(t, 5*time.Second, func() bool {
+		status, _ := write("third")
+		return status == http.StatusOK
+	})
+	if lines := readLines(t, path); len(lines) != 1 || !strings.HasSuffix(lines[0], "[2] Log: third") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestManagerTimeoutOnBlockedManager(t *testing.T) {
+	s := startServer(t, "-manager-timeout", "200ms")
+	session := s.create(t, `{"name":"blocked"}`)
+	path := s.path(session)
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -write-deadline the manager itself blocks on the FIFO
+	start := time.Now()
+	res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"stuck"}`, session.Id))
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("blocked write: got %d %s", res.StatusCode, read)
+	}
+	if res, read := s.get(t, "/list-sessions"); res.StatusCode != http.StatusServiceUnavailable || !strings.Contains(read, ManagerUnavailable) {
+		t.Errorf("list behind the blocked manager: got %d %s", res.StatusCode, read)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("requests took %s to time out", elapsed)
+	}
+
+	fifo, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(fifo)
+	fifo.Close()
+	eventually(t, 5*time.Second, func() bool {
+		res, _ := s.get(t, "/list-sessions")
+		return res.StatusCode == http.StatusOK
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Counters published at /debug/vars. Only the manager goroutine updates them.
+var (
+	SessionsOpen    = expvar.NewInt("sessions_open")
+	SessionsCreated = expvar.NewInt("sessions_created")
+	SessionsClosed  = expvar.NewInt("sessions_closed")
+	Writes          = expvar.NewInt("writes")
+	WritesFailed    = expvar.NewInt("writes_failed")
+	BytesWritten    = expvar.NewInt("bytes_written")
+)
+
+// Summarises the counters, printed when sesh shuts down.
+func CountersSummary(uptime time.Duration) string {
+	return fmt.Sprintf("sessions created=%d closed=%d open=%d, writes succeeded=%d failed=%d, bytes written=%d, uptime %s",
+		SessionsCreated.Value(), SessionsClosed.Value(), SessionsOpen.Value(), Writes.Value(), WritesFailed.Value(), BytesWritten.Value(), uptime.Round(time.Second))
+}
+
+// Serves /debug/vars without the "cmdline" variable, which would reveal any secret flag given on the command line.
+func WithVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/vars" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		vars := make(map[string]json.RawMessage)
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key != "cmdline" {
+				vars[kv.Key] = json.RawMessage(kv.Value.String())
+			}
+		})
+		encoded, err := json.Marshal(vars)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s\n", encoded)
+	})
+}
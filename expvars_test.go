@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDebugVars(t *testing.T) {
+	s := startServer(t, "-hmac-secret", "hunter2")
+	session := s.create(t, `{"name":"counted"}`)
+	s.write(t, session.Id, "hello")
+
+	_, read := s.get(t, "/debug/vars")
+	var vars map[string]interface{}
+	decode(t, read, &vars)
+	if vars["sessions_open"] != 1.0 || vars["sessions_created"] != 1.0 || vars["writes"] != 1.0 {
+		t.Errorf("got %s", read)
+	}
+	if _, exists := vars["cmdline"]; exists || strings.Contains(read, "hunter2") {
+		t.Errorf("command line exposed: %s", read)
+	}
+}
+
+func TestShutdownSummary(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"summarised"}`)
+	s.write(t, session.Id, "hello")
+	s.close(t, session.Id)
+	s.stop()
+
+	stdout, _ := s.wait(t)
+	if !strings.Contains(stdout, "Shutting down, sessions created=1 closed=1 open=0, writes succeeded=1 failed=0, bytes written=") {
+		t.Errorf("got %s", stdout)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A write to mirror to a session on another sesh server.
+type ForwardedWrite struct {
+	// Base URL of the remote server
+	URL   string
+	Id    uuid.UUID
+	Write WriteSessionRequest
+}
+
+// Mirrors writes to remote sesh servers from a background goroutine, in the order they were made locally, retrying
+// failed deliveries with backoff.
+type Forwarder struct {
+	retries int
+	client  *http.Client
+	writes  chan ForwardedWrite
+}
+
+func NewForwarder(retries int, timeout time.Duration) *Forwarder {
+	forwarder := &Forwarder{
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+		writes:  make(chan ForwardedWrite, 1024),
+	}
+	go forwarder.run()
+
+	return forwarder
+}
+
+// Queues a write. Never blocks; writes are dropped if the queue is full.
+func (f *Forwarder) Forward(write ForwardedWrite) {
+	select {
+	case f.writes <- write:
+	default:
+		log.Printf("Forward queue is full, dropping write to %s on %s", write.Id.String(), write.URL)
+	}
+}
+
+func (f *Forwarder) run() {
+	for write := range f.writes {
+		write.Write.Id = &write.Id
+		body, _ := json.Marshal(write.Write)
+		backoff := 100 * time.Millisecond
+		for attempt := 0; ; attempt++ {
+			err := f.deliver(write.URL, body)
+			if err == nil {
+				break
+			}
+			if attempt >= f.retries {
+				log.Printf("Could not forward write to %s on %s: %s", write.Id.String(), write.URL, err.Error())
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (f *Forwarder) deliver(url string, body []byte) error {
+	response, err := f.client.Post(strings.TrimSuffix(url, "/")+"/write-session", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("remote responded with %s", response.Status)
+	}
+
+	return nil
+}
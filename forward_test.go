@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestForwarderRetriesInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	failures := 1
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/write-session" || failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var write WriteSessionRequest
+		json.NewDecoder(r.Body).Decode(&write)
+		received = append(received, *write.Content)
+	}))
+	defer remote.Close()
+
+	forwarder := NewForwarder(2, time.Second)
+	for _, content := range []string{"first", "second"} {
+		content := content
+		forwarder.Forward(ForwardedWrite{URL: remote.URL + "/", Id: uuid.New(), Write: WriteSessionRequest{Content: &content}})
+	}
+	eventually(t, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	})
+	if fmt.Sprint(received) != "[first second]" {
+		t.Errorf("got %v", received)
+	}
+}
+
+func TestForwardToRemoteSesh(t *testing.T) {
+	remote := startServer(t)
+	target := remote.create(t, `{"name":"aggregated"}`)
+	local := startServer(t)
+	session := local.create(t, fmt.Sprintf(`{"name":"mirrored","forward_to":%q,"forward_id":%q}`, remote.URL, target.Id.String()))
+	local.write(t, session.Id, "both places")
+
+	eventually(t, 5*time.Second, func() bool {
+		data, _ := os.ReadFile(remote.path(target))
+		return strings.HasSuffix(string(data), "Log: both places\n")
+	})
+	if lines := readLines(t, local.path(session)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: both places") {
+		t.Errorf("local: got %q", lines)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a script to dir that records its arguments, one per line, in args.
+func writeRecordingHook(t *testing.T, dir string) (script string, args string) {
+	script = filepath.Join(dir, "hook.sh")
+	args = filepath.Join(dir, "args")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > "+args+".tmp && mv "+args+".tmp "+args+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return script, args
+}
+
+func TestOnCloseCmdGetsSessionArgs(t *testing.T) {
+	hooks := t.TempDir()
+	script, args := writeRecordingHook(t, hooks)
+	s := startServer(t, "-on-close-cmd", script)
+	name := "ship $(touch injected); `touch injected`"
+	session := s.create(t, fmt.Sprintf(`{"name":%q}`, name))
+	s.write(t, session.Id, "shipped")
+	s.close(t, session.Id)
+
+	eventually(t, 5*time.Second, func() bool {
+		_, err := os.Stat(args)
+		return err == nil
+	})
+	got := readLines(t, args)
+	if len(got) != 3 || got[0] != session.Filepath || got[1] != session.Id.String() || got[2] != name {
+		t.Errorf("got %q", got)
+	}
+	for _, dir := range []string{hooks, s.Dir} {
+		if _, err := os.Stat(filepath.Join(dir, "injected")); err == nil {
+			t.Errorf("the session name ran a command in %s", dir)
+		}
+	}
+}
+
+func TestRunHookTimesOut(t *testing.T) {
+	started := time.Now()
+	err := RunHook("sleep", 50*time.Millisecond, "10")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("took %s", elapsed)
+	}
+
+	if err := RunHook("false", time.Second); err == nil {
+		t.Error("failing command: no error")
+	}
+}
+
+func TestOnCloseCmdMustExist(t *testing.T) {
+	if output := startFailing(t, "-on-close-cmd", filepath.Join(t.TempDir(), "missing")); !strings.Contains(output, "-on-close-cmd: ") {
+		t.Errorf("got %s", output)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Counts writes per session that handlers have accepted but the manager hasn't finished, so close can wait for them.
+type InFlightWrites struct {
+	mu     sync.Mutex
+	counts map[uuid.UUID]int
+	idle   map[uuid.UUID]chan struct{}
+}
+
+func NewInFlightWrites() *InFlightWrites {
+	return &InFlightWrites{
+		counts: make(map[uuid.UUID]int),
+		idle:   make(map[uuid.UUID]chan struct{}),
+	}
+}
+
+func (f *InFlightWrites) Begin(id uuid.UUID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[id]++
+}
+
+func (f *InFlightWrites) End(id uuid.UUID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts[id]--; f.counts[id] > 0 {
+		return
+	}
+	delete(f.counts, id)
+	if idle, exists := f.idle[id]; exists {
+		close(idle)
+		delete(f.idle, id)
+	}
+}
+
+// Waits until the session has no writes in flight. Returns 'false' if they are still running after timeout.
+func (f *InFlightWrites) Wait(id uuid.UUID, timeout time.Duration) bool {
+	f.mu.Lock()
+	if f.counts[id] == 0 {
+		f.mu.Unlock()
+		return true
+	}
+	idle, exists := f.idle[id]
+	if !exists {
+		idle = make(chan struct{})
+		f.idle[id] = idle
+	}
+	f.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// A /stream-session request in progress.
+type StreamWrite struct {
+	Id        uuid.UUID `json:"id"`
+	SessionId uuid.UUID `json:"session_id"`
+	RequestId string    `json:"request_id"`
+	Started   time.Time `json:"started"`
+	Lines     int       `json:"lines"`
+
+	cancel func()
+}
+
+// Tracks running streams by write id, so one can be listed and cancelled.
+type StreamWrites struct {
+	mu      sync.Mutex
+	streams map[uuid.UUID]*StreamWrite
+}
+
+func NewStreamWrites() *StreamWrites {
+	return &StreamWrites{streams: make(map[uuid.UUID]*StreamWrite)}
+}
+
+// Registers a stream, returning its write id. cancel is called by Cancel.
+func (s *StreamWrites) Start(sessionId uuid.UUID, requestId string, cancel func()) uuid.UUID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := uuid.New()
+	s.streams[id] = &StreamWrite{Id: id, SessionId: sessionId, RequestId: requestId, Started: time.Now(), cancel: cancel}
+
+	return id
+}
+
+func (s *StreamWrites) Wrote(id uuid.UUID, lines int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stream, exists := s.streams[id]; exists {
+		stream.Lines = lines
+	}
+}
+
+func (s *StreamWrites) End(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// Cancels a stream. Returns 'false' if no stream has the id, or it already ended.
+func (s *StreamWrites) Cancel(id uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream, exists := s.streams[id]
+	if exists {
+		stream.cancel()
+	}
+
+	return exists
+}
+
+// Returns the running streams, oldest first.
+func (s *StreamWrites) List() []StreamWrite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streams := make([]StreamWrite, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, *stream)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Started.Before(streams[j].Started) })
+
+	return streams
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestInFlightWritesWait(t *testing.T) {
+	writes := NewInFlightWrites()
+	id := uuid.New()
+	if !writes.Wait(id, time.Millisecond) {
+		t.Error("no writes: waited")
+	}
+
+	writes.Begin(id)
+	writes.Begin(id)
+	if writes.Wait(id, 10*time.Millisecond) {
+		t.Error("didn't wait for writes in flight")
+	}
+	done := make(chan bool)
+	go func() { done <- writes.Wait(id, 5*time.Second) }()
+	writes.End(id)
+	writes.End(id)
+	if !<-done {
+		t.Error("wait timed out after the writes ended")
+	}
+}
+
+func TestCloseWaitsForInFlightWrite(t *testing.T) {
+	s := startServer(t, "-close-flush-timeout", "5s")
+	session := s.create(t, `{"name":"draining"}`)
+
+	// A stream stays in flight until its body ends
+	body, stream := io.Pipe()
+	streamed := make(chan int)
+	go func() {
+		res, err := http.Post(s.URL+"/stream-session?id="+session.Id.String(), "text/plain", body)
+		if err != nil {
+			streamed <- 0
+			return
+		}
+		res.Body.Close()
+		streamed <- res.StatusCode
+	}()
+	fmt.Fprintln(stream, "first")
+	eventually(t, 5*time.Second, func() bool {
+		data, _ := os.ReadFile(s.path(session))
+		return strings.Contains(string(data), "first")
+	})
+
+	closed := make(chan struct{})
+	go func() {
+		s.post(t, "/close-session", fmt.Sprintf(`{"id":%q}`, session.Id.String()))
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close didn't wait for the stream")
+	case <-time.After(200 * time.Millisecond):
+	}
+	fmt.Fprintln(stream, "second")
+	stream.Close()
+	if status := <-streamed; status != http.StatusOK {
+		t.Fatalf("stream: got %d", status)
+	}
+	<-closed
+
+	lines := readLines(t, s.path(session))
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], "Log: second") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestCancelStreamingWrite(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"cancelled"}`)
+
+	body, stream := io.Pipe()
+	defer stream.Close()
+	type result struct {
+		status  int
+		writeId string
+		body    string
+	}
+	streamed := make(chan result)
+	go func() {
+		res, err := http.Post(s.URL+"/stream-session?id="+session.Id.String(), "text/plain", body)
+		if err != nil {
+			streamed <- result{}
+			return
+		}
+		defer res.Body.Close()
+		read, _ := io.ReadAll(res.Body)
+		streamed <- result{res.StatusCode, res.Header.Get(WriteIdHeader), string(read)}
+	}()
+	fmt.Fprintln(stream, "first")
+	fmt.Fprintln(stream, "second")
+
+	var writes []StreamWrite
+	eventually(t, 5*time.Second, func() bool {
+		_, read := s.get(t, "/writes")
+		decode(t, read, &writes)
+		return len(writes) == 1 && writes[0].Lines == 2
+	})
+	if writes[0].SessionId != session.Id {
+		t.Errorf("got session %s", writes[0].SessionId)
+	}
+	writeId := writes[0].Id.String()
+	if res, read := s.post(t, "/cancel-write?id="+writeId, ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: got %d %s", res.StatusCode, read)
+	}
+
+	got := <-streamed
+	if got.status != http.StatusConflict || got.writeId != writeId || !strings.Contains(got.body, "Wrote 2 line(s)") {
+		t.Errorf("stream: got %+v", got)
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 2 {
+		t.Errorf("got %q", lines)
+	}
+	eventually(t, 5*time.Second, func() bool {
+		_, read := s.get(t, "/writes")
+		return strings.TrimSpace(read) == "[]"
+	})
+	if res, _ := s.post(t, "/cancel-write?id="+writeId, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("cancel after end: got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	IntegrityMissing   = "missing"
+	IntegrityTruncated = "truncated"
+)
+
+// An open session whose file no longer matches what sesh wrote to it.
+type IntegrityProblem struct {
+	Id       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Filepath string    `json:"filepath"`
+	Problem  string    `json:"problem"`
+	// Bytes written to the current file, and its size when checked
+	Written    uint64    `json:"written"`
+	Size       int64     `json:"size"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+type IntegrityReport struct {
+	CheckedAt time.Time          `json:"checked_at"`
+	Checked   int                `json:"checked"`
+	Problems  []IntegrityProblem `json:"problems"`
+}
+
+// Keeps the result of the last integrity check, read by /integrity while the next one runs.
+type IntegrityChecker struct {
+	mu     sync.Mutex
+	report IntegrityReport
+	// When each session's problem was first seen, so it is only logged once
+	seen map[uuid.UUID]IntegrityProblem
+}
+
+func NewIntegrityChecker() *IntegrityChecker {
+	return &IntegrityChecker{
+		report: IntegrityReport{Problems: []IntegrityProblem{}},
+		seen:   make(map[uuid.UUID]IntegrityProblem),
+	}
+}
+
+// Stats each session's file, reporting those that are missing or smaller than what was written to them. Returns the
+// problems not found by the previous check.
+func (c *IntegrityChecker) Check(sessions []Session) []IntegrityProblem {
+	report := IntegrityReport{CheckedAt: time.Now(), Problems: []IntegrityProblem{}}
+	for _, session := range sessions {
+		if session.Ephemeral || session.fileBytes == 0 {
+			continue
+		}
+		report.Checked++
+		problem := IntegrityProblem{Id: session.Id, Name: session.Name, Filepath: session.Filepath, Written: session.fileBytes, DetectedAt: report.CheckedAt}
+		info, err := os.Stat(session.Filepath)
+		if errors.Is(err, fs.ErrNotExist) {
+			problem.Problem = IntegrityMissing
+		} else if err == nil && uint64(info.Size()) < session.fileBytes {
+			problem.Problem = IntegrityTruncated
+			problem.Size = info.Size()
+		} else {
+			continue
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found []IntegrityProblem
+	seen := make(map[uuid.UUID]IntegrityProblem, len(report.Problems))
+	for i, problem := range report.Problems {
+		if previous, exists := c.seen[problem.Id]; exists && previous.Problem == problem.Problem {
+			report.Problems[i].DetectedAt = previous.DetectedAt
+		} else {
+			found = append(found, problem)
+		}
+		seen[problem.Id] = report.Problems[i]
+	}
+	c.seen = seen
+	c.report = report
+
+	return found
+}
+
+func (c *IntegrityChecker) Report() IntegrityReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.report
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestIntegrityCheck(t *testing.T) {
+	dir := t.TempDir()
+	intact := Session{Id: uuid.New(), Filepath: filepath.Join(dir, "intact"), fileBytes: 4}
+	truncated := Session{Id: uuid.New(), Filepath: filepath.Join(dir, "truncated"), fileBytes: 8}
+	missing := Session{Id: uuid.New(), Filepath: filepath.Join(dir, "missing"), fileBytes: 4}
+	unwritten := Session{Id: uuid.New(), Filepath: filepath.Join(dir, "unwritten")}
+	os.WriteFile(intact.Filepath, []byte("abcd"), 0644)
+	os.WriteFile(truncated.Filepath, []byte("abcd"), 0644)
+
+	checker := NewIntegrityChecker()
+	found := checker.Check([]Session{intact, truncated, missing, unwritten})
+	if len(found) != 2 {
+		t.Fatalf("got %+v", found)
+	}
+	problems := map[uuid.UUID]string{}
+	for _, problem := range checker.Report().Problems {
+		problems[problem.Id] = problem.Problem
+	}
+	if problems[truncated.Id] != IntegrityTruncated || problems[missing.Id] != IntegrityMissing || len(problems) != 2 {
+		t.Errorf("got %v", problems)
+	}
+	if report := checker.Report(); report.Checked != 3 {
+		t.Errorf("checked %d", report.Checked)
+	}
+
+	if again := checker.Check([]Session{intact, truncated, missing}); len(again) != 0 {
+		t.Errorf("known problems reported again: %+v", again)
+	}
+}
+
+func TestIntegrityEndpointReportsDeletedFile(t *testing.T) {
+	s := startServer(t, "-integrity-interval", "50ms")
+	session := s.create(t, `{"name":"vanishing"}`)
+	s.write(t, session.Id, "soon gone")
+	os.Remove(s.path(session))
+
+	var report IntegrityReport
+	eventually(t, 5*time.Second, func() bool {
+		_, read := s.get(t, "/integrity")
+		decode(t, read, &report)
+		return len(report.Problems) == 1
+	})
+	if problem := report.Problems[0]; problem.Id != session.Id || problem.Problem != IntegrityMissing {
+		t.Errorf("got %+v", problem)
+	}
+}
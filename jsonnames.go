@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Converts a Go style field name to snake_case, e.g. FailIfExists to fail_if_exists. snake_case names are returned unchanged.
+func SnakeCase(name string) string {
+	runes := []rune(name)
+	var builder strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Start a word after a lower case letter or digit, or at the last capital of an acronym
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) && runes[i-1] != '_' {
+				builder.WriteRune('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
+
+// Decodes a JSON request body into v. Top level keys may use the snake_case names in the json tags or the Go field names
+// accepted before the tags were added. Keys of nested objects, such as a write's Fields, are left as they are. With strict,
+// unknown keys are an error rather than ignored.
+func DecodeRequest(r io.Reader, v interface{}, strict bool) error {
+	var object map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&object); err != nil {
+		return err
+	}
+	normalized := make(map[string]json.RawMessage, len(object))
+	for key, value := range object {
+		normalized[SnakeCase(key)] = value
+	}
+	encoded, err := json.Marshal(normalized)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+
+	return decoder.Decode(v)
+}
+
+// Returns a JSON encoder for a response body, indenting with two spaces when pretty is set.
+func ResponseEncoder(w io.Writer, pretty bool) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+
+	return encoder
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"Id":           "id",
+		"FailIfExists": "fail_if_exists",
+		"ParentId":     "parent_id",
+		"HTTPStatus":   "http_status",
+		"Charset8":     "charset8",
+		"lease_token":  "lease_token",
+	} {
+		if got := SnakeCase(name); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestDecodeRequestAcceptsGoNames(t *testing.T) {
+	var request WriteSessionRequest
+	err := DecodeRequest(strings.NewReader(`{"Id":"0123abcd-0000-0000-0000-000000000000","Content":"hi","Fields":{"UserId":1}}`), &request, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Id == nil || request.Id.String() != "0123abcd-0000-0000-0000-000000000000" || *request.Content != "hi" {
+		t.Errorf("got %+v", request)
+	}
+	if _, kept := request.Fields["UserId"]; !kept {
+		t.Errorf("nested keys renamed: %v", request.Fields)
+	}
+
+	if err := DecodeRequest(strings.NewReader(`{"content":"hi","nope":1}`), &request, true); err == nil {
+		t.Error("strict: unknown key accepted")
+	}
+	if err := DecodeRequest(strings.NewReader(`{"content":"hi","nope":1}`), &request, false); err != nil {
+		t.Errorf("unknown key rejected: %s", err.Error())
+	}
+}
+
+func TestResponsesUseSnakeCase(t *testing.T) {
+	s := startServer(t)
+	_, read := s.post(t, "/create-session", `{"Name":"legacy","FailIfExists":true}`)
+	var fields map[string]interface{}
+	decode(t, read, &fields)
+	if fields["name"] != "legacy" || fields["creation_time"] == nil {
+		t.Errorf("got %s", read)
+	}
+	for key := range fields {
+		if key != strings.ToLower(key) {
+			t.Errorf("key %s isn't lower case", key)
+		}
+	}
+
+	_, read = s.post(t, "/write-session", fmt.Sprintf(`{"Id":%q,"Content":"old style"}`, fields["id"]))
+	if !strings.Contains(read, `"message":`) || !strings.Contains(read, `"status":200`) {
+		t.Errorf("write: got %s", read)
+	}
+}
+
+func TestPrettyResponses(t *testing.T) {
+	for _, pretty := range []bool{true, false} {
+		s := startServer(t, fmt.Sprintf("-pretty=%v", pretty))
+		session := s.create(t, `{"name":"indented"}`)
+		_, read := s.get(t, "/list-sessions")
+
+		var want bytes.Buffer
+		if pretty {
+			json.Indent(&want, []byte(strings.TrimSuffix(read, "\n")), "", "  ")
+		} else {
+			json.Compact(&want, []byte(strings.TrimSuffix(read, "\n")))
+		}
+		if got := strings.TrimSuffix(read, "\n"); got != want.String() {
+			t.Errorf("pretty %v: got %s", pretty, read)
+		}
+		if indented := strings.Contains(read, "\n  \"sessions\": ["); indented != pretty {
+			t.Errorf("pretty %v: got %s", pretty, read)
+		}
+		if !strings.Contains(read, session.Id.String()) {
+			t.Errorf("pretty %v: session missing from %s", pretty, read)
+		}
+	}
+}
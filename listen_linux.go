@@ -0,0 +1,54 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// SO_REUSEPORT, which package syscall doesn't define for Linux. mips uses a different value and listen_other.go.
+const soReusePort = 0xf
+
+// Listens on addr. Go already sets SO_REUSEADDR, so a restart can bind while old connections are in TIME_WAIT; reusePort
+// also sets SO_REUSEPORT, letting a new process bind before the old one has exited. A backlog above 0 replaces the
+// system default, somaxconn.
+func Listen(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var err error
+			controlErr := conn.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if err == nil && reusePort {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+				}
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	listener, err := config.Listen(context.Background(), "tcp", addr)
+	if err != nil || backlog <= 0 {
+		return listener, err
+	}
+
+	// Linux applies a new backlog when listen is called again on a listening socket
+	raw, err := listener.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		controlErr := raw.Control(func(fd uintptr) {
+			err = syscall.Listen(int(fd), backlog)
+		})
+		if err == nil {
+			err = controlErr
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,26 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package main
+
+import (
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := Listen("127.0.0.1:0", true, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := Listen(first.Addr().String(), true, 16)
+	if err != nil {
+		t.Fatalf("second listener with SO_REUSEPORT: %s", err)
+	}
+	second.Close()
+
+	if third, err := Listen(first.Addr().String(), false, 0); err == nil {
+		third.Close()
+		t.Error("listener without SO_REUSEPORT bound a port already in use")
+	}
+}
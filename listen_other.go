@@ -0,0 +1,17 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Listens on addr. Setting SO_REUSEPORT or the backlog is only supported on Linux, other than mips.
+func Listen(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	if reusePort || backlog > 0 {
+		return nil, errors.New("-reuse-port and -listen-backlog are only supported on Linux, other than mips")
+	}
+
+	return net.Listen("tcp", addr)
+}
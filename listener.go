@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// Closes connections accepted beyond a limit straight away, rather than letting them queue.
+type LimitListener struct {
+	net.Listener
+	mu     sync.Mutex
+	open   int
+	max    int
+	logged bool
+}
+
+func NewLimitListener(listener net.Listener, max int) *LimitListener {
+	return &LimitListener{Listener: listener, max: max}
+}
+
+func (l *LimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		if l.open >= l.max {
+			// Logged once per flood, so the log isn't flooded too
+			if !l.logged {
+				log.Printf("Refusing connections beyond -max-connections=%d", l.max)
+				l.logged = true
+			}
+			l.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		l.open++
+		l.logged = false
+		l.mu.Unlock()
+
+		return &limitedConn{Conn: conn, listener: l}, nil
+	}
+}
+
+func (l *LimitListener) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+}
+
+type limitedConn struct {
+	net.Conn
+	once     sync.Once
+	listener *LimitListener
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.listener.release)
+
+	return err
+}
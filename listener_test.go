@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Sends a GET over conn and returns the response status, or an error if the connection was closed.
+func getOver(conn net.Conn, path string) (int, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: sesh\r\n\r\n"); err != nil {
+		return 0, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	return res.StatusCode, nil
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := startServer(t, "-max-connections", "2")
+	var open []net.Conn
+	// The connection startServer checked the server with may take a moment to be released
+	eventually(t, 5*time.Second, func() bool {
+		conn, err := net.Dial("tcp", s.Addr)
+		if err != nil {
+			return false
+		}
+		if status, err := getOver(conn, "/list-sessions"); err != nil || status != http.StatusOK {
+			conn.Close()
+			return false
+		}
+		open = append(open, conn)
+		return len(open) == 2
+	})
+	defer func() {
+		for _, conn := range open {
+			conn.Close()
+		}
+	}()
+
+	excess, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer excess.Close()
+	if status, err := getOver(excess, "/list-sessions"); err == nil {
+		t.Errorf("excess connection served with %d", status)
+	}
+
+	open[0].Close()
+	eventually(t, 5*time.Second, func() bool {
+		conn, err := net.Dial("tcp", s.Addr)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		status, err := getOver(conn, "/list-sessions")
+		return err == nil && status == http.StatusOK
+	})
+}
+
+func TestRestartBindsSamePort(t *testing.T) {
+	first := startServer(t)
+	// Connections the server closes itself stay in TIME_WAIT on its port
+	for i := 0; i < 5; i++ {
+		first.get(t, "/list-sessions", "Connection", "close")
+	}
+	first.stop()
+
+	second := startServerOn(t, first.Addr)
+	if res, read := second.get(t, "/list-sessions"); res.StatusCode != http.StatusOK {
+		t.Errorf("got %d %s", res.StatusCode, read)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Set in the environment of a re-executed test binary to run sesh's main instead of the tests.
+const serverEnv = "SESH_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(serverEnv) == "1" {
+		os.Args = append([]string{"sesh"}, os.Args[1:]...)
+		main()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// Collects a process's output while it's still running.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// A sesh server running as a child process, writing its logs to Dir.
+type testServer struct {
+	URL    string
+	Addr   string
+	Dir    string
+	cmd    *exec.Cmd
+	stdout *syncBuffer
+	stderr *syncBuffer
+	done   chan struct{}
+}
+
+// Returns a free local address to listen on.
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// Starts sesh with -addr and -log-dir set to a free port and a temporary directory, followed by args, and stops it when
+// the test ends.
+func startServer(t testing.TB, args ...string) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	for attempt := 0; ; attempt++ {
+		s, err := tryStartServer(dir, "", args)
+		if err == nil {
+			t.Cleanup(s.stop)
+			return s
+		}
+		// Another process may take the free port before sesh binds it
+		if !strings.Contains(err.Error(), "address already in use") || attempt == 2 {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Starts sesh on addr, or on a free port if addr is empty.
+func startServerOn(t testing.TB, addr string, args ...string) *testServer {
+	t.Helper()
+	s, err := tryStartServer(t.TempDir(), addr, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.stop)
+
+	return s
+}
+
+func tryStartServer(dir string, addr string, args []string) (*testServer, error) {
+	if addr == "" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		addr = listener.Addr().String()
+		listener.Close()
+	}
+
+	s := &testServer{
+		URL:    "http://" + addr,
+		Addr:   addr,
+		Dir:    dir,
+		stdout: &syncBuffer{},
+		stderr: &syncBuffer{},
+		done:   make(chan struct{}),
+	}
+	s.cmd = exec.Command(os.Args[0], append([]string{"-addr", s.Addr, "-log-dir", s.Dir}, args...)...)
+	s.cmd.Env = append(os.Environ(), serverEnv+"=1")
+	s.cmd.Dir = s.Dir
+	s.cmd.Stdout = s.stdout
+	s.cmd.Stderr = s.stderr
+	if err := s.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+
+	// Whatever answers must be this server, not another that took the port
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: time.Second}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if res, err := client.Get(s.URL + "/config"); err == nil {
+			var config map[string]string
+			err = json.NewDecoder(res.Body).Decode(&config)
+			res.Body.Close()
+			if err == nil && config["log-dir"] == s.Dir {
+				return s, nil
+			}
+		}
+		select {
+		case <-s.done:
+			return nil, fmt.Errorf("sesh exited before listening: %s", s.stderr.String())
+		default:
+		}
+		if time.Now().After(deadline) {
+			s.stop()
+			return nil, fmt.Errorf("sesh did not start listening: %s", s.stderr.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Runs sesh with args, expecting it to exit with an error before it starts listening. Returns its output.
+func startFailing(t testing.TB, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-addr", freeAddr(t), "-log-dir", t.TempDir()}, args...)...)
+	cmd.Env = append(os.Environ(), serverEnv+"=1")
+	done := make(chan struct{})
+	timer := time.AfterFunc(15*time.Second, func() {
+		cmd.Process.Kill()
+		close(done)
+	})
+	output, err := cmd.CombinedOutput()
+	if !timer.Stop() {
+		<-done
+		t.Fatal("sesh did not exit")
+	}
+	if err == nil {
+		t.Fatalf("sesh exited successfully: %s", output)
+	}
+
+	return string(output)
+}
+
+// Stops the server gracefully, killing it if it doesn't exit in time.
+func (s *testServer) stop() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.done:
+	case <-time.After(15 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+// Waits for the server to exit, returning its stdout and stderr.
+func (s *testServer) wait(t testing.TB) (string, string) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("sesh did not exit")
+	}
+
+	return s.stdout.String(), s.stderr.String()
+}
+
+// Sends a request and returns the response with its body read.
+func (s *testServer) do(t testing.TB, method string, path string, body string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	read, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, string(read)
+}
+
+func (s *testServer) get(t testing.TB, path string, header ...string) (*http.Response, string) {
+	t.Helper()
+	return s.do(t, "GET", path, "", header...)
+}
+
+func (s *testServer) post(t testing.TB, path string, body string, header ...string) (*http.Response, string) {
+	t.Helper()
+	return s.do(t, "POST", path, body, header...)
+}
+
+// Decodes a response body into v, failing the test if it isn't valid JSON.
+func decode(t testing.TB, body string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("could not decode %q: %s", body, err.Error())
+	}
+}
+
+// Creates a session from a JSON request body and returns it.
+func (s *testServer) create(t testing.TB, body string) Session {
+	t.Helper()
+	res, read := s.post(t, "/create-session", body)
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		t.Fatalf("create %s: %d %s", body, res.StatusCode, read)
+	}
+	var session Session
+	decode(t, read, &session)
+
+	return session
+}
+
+// Writes content to a session, failing the test unless the write is answered with 200.
+func (s *testServer) write(t testing.TB, id fmt.Stringer, content string) WriteSessionResponse {
+	t.Helper()
+	encoded, _ := json.Marshal(content)
+	res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":%s}`, id.String(), encoded))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("write %q: %d %s", content, res.StatusCode, read)
+	}
+	var response WriteSessionResponse
+	decode(t, read, &response)
+
+	return response
+}
+
+func (s *testServer) close(t testing.TB, id fmt.Stringer) {
+	t.Helper()
+	res, read := s.post(t, "/close-session", fmt.Sprintf(`{"id":%q}`, id.String()))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("close %s: %d %s", id.String(), res.StatusCode, read)
+	}
+}
+
+// Reads a session's log through /read-session.
+func (s *testServer) read(t testing.TB, id fmt.Stringer) string {
+	t.Helper()
+	res, read := s.get(t, "/read-session?id="+id.String())
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("read %s: %d %s", id.String(), res.StatusCode, read)
+	}
+
+	return read
+}
+
+// Returns the names of the files in dir.
+func listDir(t testing.TB, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+
+	return names
+}
+
+// Returns the lines of a file, without their newlines.
+func readLines(t testing.TB, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// Returns the path of a session's file in the server's log directory.
+func (s *testServer) path(session Session) string {
+	return filepath.Join(s.Dir, filepath.Base(session.Filepath))
+}
+
+// Retries check until it returns true, failing the test after timeout.
+func eventually(t testing.TB, timeout time.Duration, check func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !check(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Lists open sessions through /list-sessions with the given query.
+func (s *testServer) list(t testing.TB, query string) ListSession {
+	t.Helper()
+	res, read := s.get(t, "/list-sessions?"+query)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("list %s: %d %s", query, res.StatusCode, read)
+	}
+	var list ListSession
+	decode(t, read, &list)
+
+	return list
+}
+
+// Returns the ids of sessions.
+func sessionIds(sessions []Session) map[string]bool {
+	ids := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		ids[session.Id.String()] = true
+	}
+
+	return ids
+}
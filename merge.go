@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// A session log to merge.
+type LogSource struct {
+	Name   string
+	Format string
+	// Opens the log for reading. Fails with fs.ErrNotExist if nothing has been written yet
+	Open func() (io.ReadCloser, error)
+}
+
+// Returns the source for a session's log as UTF-8, across all of its shards if it has them.
+func SessionLogSource(session Session) LogSource {
+	return LogSource{
+		Name:   session.Name,
+		Format: session.Format,
+		Open:   func() (io.ReadCloser, error) { return OpenSessionText(session) },
+	}
+}
+
+type mergeCursor struct {
+	source LogSource
+	index  int
+	reader *bufio.Reader
+	file   io.Closer
+	line   []byte
+	time   time.Time
+}
+
+// Min-heap of cursors ordered by the time of their current line, then by source order.
+type mergeHeap []*mergeCursor
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].time.Equal(h[j].time) {
+		return h[i].index < h[j].index
+	}
+	return h[i].time.Before(h[j].time)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeCursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// Parses the timestamp of a log line: the leading token for text sessions, the 'time' field for JSON sessions.
+func LineTime(line []byte, format string) (time.Time, bool) {
+	if format == FormatJSON {
+		var object struct{ Time string }
+		if json.Unmarshal(line, &object) != nil {
+			return time.Time{}, false
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, object.Time)
+		return parsed, err == nil
+	}
+
+	token := line
+	if space := bytes.IndexByte(line, ' '); space >= 0 {
+		token = line[:space]
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, string(bytes.TrimSpace(token)))
+	return parsed, err == nil
+}
+
+// Reads the cursor's next line. Lines without a timestamp inherit the previous line's so they stay in place.
+func (c *mergeCursor) advance() bool {
+	line, err := c.reader.ReadBytes('\n')
+	if len(line) == 0 && err != nil {
+		return false
+	}
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+	c.line = line
+	if parsed, ok := LineTime(line, c.source.Format); ok {
+		c.time = parsed
+	}
+
+	return true
+}
+
+// Streams the lines of all sources to w in chronological order, each prefixed with its session name.
+// Only one line per source is held in memory at a time.
+func MergeLogs(w io.Writer, sources []LogSource) error {
+	cursors := &mergeHeap{}
+	defer func() {
+		for _, cursor := range *cursors {
+			cursor.file.Close()
+		}
+	}()
+
+	for i, source := range sources {
+		file, err := source.Open()
+		if err != nil {
+			// Sessions that haven't been written to have no file
+			continue
+		}
+		cursor := &mergeCursor{source: source, index: i, reader: bufio.NewReader(file), file: file}
+		if !cursor.advance() {
+			file.Close()
+			continue
+		}
+		heap.Push(cursors, cursor)
+	}
+
+	out := bufio.NewWriter(w)
+	for cursors.Len() > 0 {
+		cursor := (*cursors)[0]
+		if _, err := out.WriteString("[" + cursor.source.Name + "] "); err != nil {
+			return err
+		}
+		if _, err := out.Write(cursor.line); err != nil {
+			return err
+		}
+		if cursor.advance() {
+			heap.Fix(cursors, 0)
+		} else {
+			cursor.file.Close()
+			heap.Pop(cursors)
+		}
+	}
+
+	return out.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Returns a source reading content.
+func stringSource(name string, format string, content string) LogSource {
+	return LogSource{
+		Name:   name,
+		Format: format,
+		Open:   func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(content)), nil },
+	}
+}
+
+func TestMergeLogsInterleaves(t *testing.T) {
+	var merged bytes.Buffer
+	err := MergeLogs(&merged, []LogSource{
+		stringSource("a", FormatText, "2026-10-14T00:00:01Z [1] Log: a1\n2026-10-14T00:00:03Z [2] Log: a2\n  continued\n"),
+		stringSource("b", FormatJSON, `{"time":"2026-10-14T00:00:02Z","content":"b1"}`+"\n"+`{"time":"2026-10-14T00:00:04Z","content":"b2"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[a] 2026-10-14T00:00:01Z [1] Log: a1\n" +
+		`[b] {"time":"2026-10-14T00:00:02Z","content":"b1"}` + "\n" +
+		"[a] 2026-10-14T00:00:03Z [2] Log: a2\n" +
+		"[a]   continued\n" +
+		`[b] {"time":"2026-10-14T00:00:04Z","content":"b2"}` + "\n"
+	if merged.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", merged.String(), want)
+	}
+}
+
+func TestLogsEndpointSorted(t *testing.T) {
+	s := startServer(t)
+	first := s.create(t, `{"name":"first"}`)
+	second := s.create(t, `{"name":"second"}`)
+	for i := 0; i < 4; i++ {
+		target := first
+		if i%2 == 1 {
+			target = second
+		}
+		s.write(t, target.Id, fmt.Sprintf("line %d", i))
+	}
+
+	_, read := s.get(t, "/logs")
+	lines := strings.Split(strings.TrimSuffix(read, "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %q", read)
+	}
+	for i, line := range lines {
+		name := "[first] "
+		if i%2 == 1 {
+			name = "[second] "
+		}
+		if !strings.HasPrefix(line, name) || !strings.HasSuffix(line, fmt.Sprintf("Log: line %d", i)) {
+			t.Errorf("line %d is %q", i, line)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+const ClientIdHeader = "X-Client-Id"
+
+const LeaseTokenHeader = "X-Lease-Token"
+
+// Identifies a /stream-session request for /cancel-write.
+const WriteIdHeader = "X-Write-Id"
+
+// Carries 'sha256=<hex>', the HMAC-SHA256 of the response body keyed with -hmac-secret.
+const SignatureHeader = "X-Signature"
+
+type requestIdKey struct{}
+
+// Records the status code written by a handler for access logging.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	s.Status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *StatusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Returns the request id assigned by WithRequestId.
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Propagates the incoming X-Request-Id (or generates one), echoes it in the response and writes an access log line.
+func WithRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		start := time.Now()
+		recorder := &StatusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+		fmt.Printf("%s %s %d %s request_id=%s\n", r.Method, r.URL.Path, recorder.Status, time.Since(start), id)
+	})
+}
+
+// Identifies the client making a request: the X-Client-Id header if given, otherwise a hash of its bearer token.
+// Raw tokens are never returned. Returns "" for anonymous requests.
+func ClientIdentity(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get(ClientIdHeader)); id != "" {
+		return id
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" && token != r.Header.Get("Authorization") {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:8])
+	}
+
+	return ""
+}
+
+// Endpoints that create or change sessions, rejected by WithReadOnly.
+var MutatingPaths = map[string]bool{
+	"/create-session":  true,
+	"/write-session":   true,
+	"/stream-session":  true,
+	"/replay":          true,
+	"/close-session":   true,
+	"/move-session":    true,
+	"/renew-session":   true,
+	"/rotate-session":  true,
+	"/pause-session":   true,
+	"/resume-session":  true,
+	"/update-tags":     true,
+	"/cancel-write":    true,
+	"/close-by-tag":    true,
+	"/compact-session": true,
+}
+
+// Rejects requests to MutatingPaths with 403, leaving everything else to next.
+func WithReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if MutatingPaths[r.URL.Path] {
+			http.Error(w, "sesh is running in read-only mode", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Holds a response back until the handler is done, so its signature can be sent as a header before the body.
+type signingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (s *signingWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+func (s *signingWriter) Write(data []byte) (int, error) {
+	return s.body.Write(data)
+}
+
+// Signs every response body with an HMAC-SHA256 keyed with secret, sent in SignatureHeader. Responses are buffered in
+// full to do so.
+func WithSignature(next http.Handler, secret []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signing := &signingWriter{ResponseWriter: w}
+		next.ServeHTTP(signing, r)
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signing.body.Bytes())
+		w.Header().Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		if signing.status != 0 {
+			w.WriteHeader(signing.status)
+		}
+		w.Write(signing.body.Bytes())
+	})
+}
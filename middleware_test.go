@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestIdEchoed(t *testing.T) {
+	s := startServer(t)
+	res, _ := s.get(t, "/list-sessions", RequestIdHeader, "trace-1234")
+	if got := res.Header.Get(RequestIdHeader); got != "trace-1234" {
+		t.Errorf("got %q", got)
+	}
+	eventually(t, 5*time.Second, func() bool {
+		return strings.Contains(s.stdout.String(), "GET /list-sessions 200 ") && strings.Contains(s.stdout.String(), "request_id=trace-1234")
+	})
+}
+
+func TestRequestIdGenerated(t *testing.T) {
+	var seen string
+	handler := WithRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestId(r)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if got := recorder.Header().Get(RequestIdHeader); got == "" || got != seen {
+		t.Errorf("header %q, request id %q", got, seen)
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if got := ClientIdentity(r); got != "" {
+		t.Errorf("anonymous: got %q", got)
+	}
+	r.Header.Set("Authorization", "Bearer secret-token")
+	hashed := ClientIdentity(r)
+	if !strings.HasPrefix(hashed, "token:") || strings.Contains(hashed, "secret-token") {
+		t.Errorf("token: got %q", hashed)
+	}
+	r.Header.Set(ClientIdHeader, "ci-runner")
+	if got := ClientIdentity(r); got != "ci-runner" {
+		t.Errorf("client id: got %q", got)
+	}
+}
+
+func TestListSessionsByOwner(t *testing.T) {
+	s := startServer(t)
+	create := func(client string) Session {
+		res, read := s.post(t, "/create-session", `{"name":"owned"}`, ClientIdHeader, client)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got %d %s", res.StatusCode, read)
+		}
+		var session Session
+		decode(t, read, &session)
+		return session
+	}
+	alice := create("alice")
+	create("bob")
+	create("bob")
+
+	list := s.list(t, "owner=alice")
+	if len(list.Sessions) != 1 || list.Sessions[0].Id != alice.Id || list.Sessions[0].Owner != "alice" {
+		t.Errorf("got %+v", list.Sessions)
+	}
+	if list := s.list(t, "owner=bob"); len(list.Sessions) != 2 {
+		t.Errorf("got %d sessions for bob", len(list.Sessions))
+	}
+}
+
+func TestReadOnlyRejectsMutations(t *testing.T) {
+	s := startServer(t, "-read-only")
+	eventually(t, 5*time.Second, func() bool { return strings.Contains(s.stdout.String(), "read-only mode") })
+	for path, body := range map[string]string{
+		"/create-session": `{"name":"nope"}`,
+		"/write-session":  `{"id":"00000000-0000-0000-0000-000000000000","content":"nope"}`,
+		"/close-session":  `{"id":"00000000-0000-0000-0000-000000000000"}`,
+	} {
+		if res, read := s.post(t, path, body); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %d %s", path, res.StatusCode, read)
+		}
+	}
+	for _, path := range []string{"/list-sessions", "/logs", "/config"} {
+		if res, read := s.get(t, path); res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d %s", path, res.StatusCode, read)
+		}
+	}
+}
+
+func TestWithReadOnlyPassesReads(t *testing.T) {
+	served := false
+	handler := WithReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/read-session?id=x", nil))
+	if !served {
+		t.Error("read rejected")
+	}
+	served = false
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/write-session", nil))
+	if served || recorder.Code != http.StatusForbidden {
+		t.Errorf("write: served %v, got %d", served, recorder.Code)
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	s := startServer(t, "-create-rate", "100")
+	auth := []string{"Authorization", "Bearer secret-token"}
+	for i := 0; i < 2; i++ {
+		if res, read := s.post(t, "/create-session", `{"name":"mine"}`, auth...); res.StatusCode != http.StatusOK {
+			t.Fatalf("got %d %s", res.StatusCode, read)
+		}
+	}
+	s.create(t, `{"name":"anonymous"}`)
+
+	res, read := s.get(t, "/whoami", auth...)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var whoami WhoAmIResponse
+	decode(t, read, &whoami)
+	if whoami.SessionsOwned != 2 || !strings.HasPrefix(whoami.Identity, "token:") || strings.Contains(read, "secret-token") {
+		t.Errorf("got %s", read)
+	}
+	if whoami.CreatesRemaining == nil || *whoami.CreatesRemaining >= 100 {
+		t.Errorf("creates remaining: got %v", whoami.CreatesRemaining)
+	}
+}
+
+func TestResponsesSigned(t *testing.T) {
+	s := startServer(t, "-hmac-secret", "hunter2")
+	s.create(t, `{"name":"signed"}`)
+	for path, status := range map[string]int{"/list-sessions": http.StatusOK, "/read-session?id=" + uuid.New().String(): http.StatusNotFound} {
+		res, read := s.get(t, path)
+		if res.StatusCode != status {
+			t.Errorf("%s: got %d, want %d", path, res.StatusCode, status)
+		}
+		mac := hmac.New(sha256.New, []byte("hunter2"))
+		mac.Write([]byte(read))
+		if got, want := res.Header.Get(SignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	if res, _ := startServer(t).get(t, "/list-sessions"); res.Header.Get(SignatureHeader) != "" {
+		t.Error("signed without -hmac-secret")
+	}
+}
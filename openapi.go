@@ -0,0 +1,266 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	uuidType = reflect.TypeOf(uuid.UUID{})
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// Builds OpenAPI schemas from Go types, collecting named structs under components.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == uuidType:
+		return map[string]interface{}{"type": "string", "format": "uuid"}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, exists := b.components[t.Name()]; !exists {
+			// Reserve the name first so recursive types terminate
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.structSchema(t)
+		}
+		return ref(t.Name())
+	}
+
+	// interface{} and anything else accepts any value
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if _, tagged := field.Tag.Lookup("json"); field.Anonymous && !tagged && field.Type.Kind() == reflect.Struct {
+			// Embedded structs are flattened, as encoding/json does
+			for name, property := range b.structSchema(field.Type)["properties"].(map[string]interface{}) {
+				properties[name] = property
+			}
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+		properties[name] = b.schema(field.Type)
+	}
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func jsonBody(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// Accepts a JSON write or, with ?id=, the content itself as text/plain.
+func writeBody(schema map[string]interface{}) map[string]interface{} {
+	body := jsonBody(schema)
+	body["content"].(map[string]interface{})["text/plain"] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	return body
+}
+
+func textResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+		},
+	}
+}
+
+func jsonResponse(description string, schema map[string]interface{}) map[string]interface{} {
+	response := jsonBody(schema)
+	response["description"] = description
+	return response
+}
+
+// Adds a string alternative in mediaType, chosen with an Accept header, to a JSON response.
+func withString(response map[string]interface{}, mediaType string) map[string]interface{} {
+	response["content"].(map[string]interface{})[mediaType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+	return response
+}
+
+// Builds the OpenAPI 3 description of the core endpoints. Schemas are generated from the request and response types.
+func OpenAPISpec() map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+
+	paths := map[string]interface{}{
+		"/create-session": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary":     "Create a session",
+				"requestBody": jsonBody(b.schema(reflect.TypeOf(CreateSessionRequest{}))),
+				"responses": map[string]interface{}{
+					"200": withString(jsonResponse("The created session, or the existing one with create_if_not_exists. Only the id is returned with -terse-responses, or as text with Accept: text/plain, the lease token then being in X-Lease-Token", map[string]interface{}{
+						"oneOf": []interface{}{b.schema(reflect.TypeOf(CreatedSession{})), b.schema(reflect.TypeOf(CreateSessionResponse{}))},
+					}), "text/plain"),
+					"201": withString(jsonResponse("The session created with create_if_not_exists", map[string]interface{}{
+						"oneOf": []interface{}{b.schema(reflect.TypeOf(CreatedSession{})), b.schema(reflect.TypeOf(CreateSessionResponse{}))},
+					}), "text/plain"),
+					"400": textResponse("Invalid create session object"),
+					"403": textResponse("dir is not within -allowed-dirs"),
+					"409": textResponse("The session's file already exists, with fail_if_exists"),
+					"429": textResponse("Sessions are being created faster than -create-rate"),
+					"503": textResponse("The session manager did not respond in time"),
+				},
+			},
+		},
+		"/list-sessions": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "List open sessions",
+				"parameters": []interface{}{
+					map[string]interface{}{
+						"name":        "active_within",
+						"in":          "query",
+						"description": "Only return sessions written to within this duration, e.g. 5m",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+					map[string]interface{}{
+						"name":        "parent",
+						"in":          "query",
+						"description": "Only return children of this session",
+						"schema":      map[string]interface{}{"type": "string", "format": "uuid"},
+					},
+					map[string]interface{}{
+						"name":        "limit",
+						"in":          "query",
+						"description": "Return at most this many sessions, ordered by id, with a cursor for the next page in next",
+						"schema":      map[string]interface{}{"type": "integer"},
+					},
+					map[string]interface{}{
+						"name":        "cursor",
+						"in":          "query",
+						"description": "next from the previous page",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+					map[string]interface{}{
+						"name":        "owner",
+						"in":          "query",
+						"description": "Only return sessions created by this identity, as reported by /whoami",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+					map[string]interface{}{
+						"name":        "preview",
+						"in":          "query",
+						"description": "Include the last line of each session's file in previews",
+						"schema":      map[string]interface{}{"type": "boolean"},
+					},
+					map[string]interface{}{
+						"name":        "format",
+						"in":          "query",
+						"description": "csv for one row per session with id, name, creation_time and filepath columns, also chosen with Accept: text/csv",
+						"schema":      map[string]interface{}{"type": "string", "enum": []interface{}{"csv"}},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": withString(jsonResponse("Open sessions", b.schema(reflect.TypeOf(ListSession{}))), "text/csv"),
+					"400": textResponse("Invalid filter or cursor"),
+					"503": textResponse("The session manager did not respond in time"),
+				},
+			},
+		},
+		"/close-session": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary":     "Close a session",
+				"requestBody": jsonBody(b.schema(reflect.TypeOf(CloseSessionRequest{}))),
+				"parameters": []interface{}{
+					map[string]interface{}{
+						"name":        "idempotent",
+						"in":          "query",
+						"description": "Succeed when the session is already closed or unknown",
+						"schema":      map[string]interface{}{"type": "boolean"},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": textResponse("Session closed"),
+					"400": textResponse("Session does not exist"),
+					"500": textResponse("final_content could not be written, the session is left open"),
+					"503": textResponse("The session manager did not respond in time"),
+				},
+			},
+		},
+		"/write-session": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary":     "Append a line to a session",
+				"requestBody": writeBody(b.schema(reflect.TypeOf(WriteSessionRequest{}))),
+				"parameters": []interface{}{
+					map[string]interface{}{
+						"name":        "id",
+						"in":          "query",
+						"description": "Session to write to, required with a text/plain body",
+						"schema":      map[string]interface{}{"type": "string", "format": "uuid"},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": jsonResponse("Line written, or skipped as below the session's min_level, empty or a duplicate", b.schema(reflect.TypeOf(WriteSessionResponse{}))),
+					"400": textResponse("Invalid write or unknown session"),
+					"403": textResponse("A valid lease token is required, with -lease"),
+					"409": textResponse("The session's lease has expired"),
+					"410": textResponse("Session was closed within -gone-window"),
+					"413": textResponse("A text/plain body is larger than the longest line allowed"),
+					"423": textResponse("The session is paused"),
+					"500": textResponse("Line could not be written"),
+					"503": textResponse("The session manager did not respond in time, or a write abandoned by -write-deadline hasn't returned yet"),
+					"504": textResponse("The write took longer than -write-deadline and may still land"),
+					"507": textResponse("The disk is full"),
+				},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "sesh",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": b.components},
+	}
+}
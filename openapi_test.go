@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Decoded just enough to check which paths and parameters are described.
+type openAPIDocument struct {
+	OpenAPI string `json:"openapi"`
+	Paths   map[string]map[string]struct {
+		Parameters []struct {
+			Name string `json:"name"`
+		} `json:"parameters"`
+		Responses map[string]struct {
+			Content map[string]interface{} `json:"content"`
+		} `json:"responses"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+}
+
+func TestOpenAPISpecListsCorePaths(t *testing.T) {
+	s := startServer(t)
+	res, read := s.get(t, "/openapi.json")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var spec openAPIDocument
+	if err := json.Unmarshal([]byte(read), &spec); err != nil {
+		t.Fatalf("spec is not valid JSON: %s", err.Error())
+	}
+	if spec.OpenAPI == "" {
+		t.Error("openapi version missing")
+	}
+	for path, method := range map[string]string{"/create-session": "post", "/list-sessions": "get", "/close-session": "post", "/write-session": "post"} {
+		if _, ok := spec.Paths[path][method]; !ok {
+			t.Errorf("%s %s is not described", method, path)
+		}
+	}
+	for _, schema := range []string{"CreateSessionRequest", "WriteSessionRequest", "CloseSessionRequest", "ListSession", "Session"} {
+		if _, ok := spec.Components.Schemas[schema]; !ok {
+			t.Errorf("schema %s is missing", schema)
+		}
+	}
+}
+
+func TestOpenAPISpecListSessionsParameters(t *testing.T) {
+	encoded, err := json.Marshal(OpenAPISpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPIDocument
+	json.Unmarshal(encoded, &spec)
+	list := spec.Paths["/list-sessions"]["get"]
+
+	described := make(map[string]bool)
+	for _, parameter := range list.Parameters {
+		described[parameter.Name] = true
+	}
+	for _, name := range []string{"active_within", "parent", "limit", "cursor", "owner", "preview", "format"} {
+		if !described[name] {
+			t.Errorf("parameter %s is not described", name)
+		}
+	}
+	if _, ok := list.Responses["200"].Content["text/csv"]; !ok {
+		t.Error("the CSV response is not described")
+	}
+}
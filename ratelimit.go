@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A token bucket refilled at rate tokens per second, holding at most burst tokens.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	burst := math.Max(1, math.Ceil(rate))
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Takes a token if one is available. Returns 'false' if the caller is over the limit.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// Number of whole tokens currently available.
+func (b *TokenBucket) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+
+	return int(b.tokens)
+}
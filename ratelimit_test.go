@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(2)
+	if !bucket.Allow() || !bucket.Allow() {
+		t.Fatal("burst of 2 not allowed")
+	}
+	if bucket.Allow() {
+		t.Error("third token allowed")
+	}
+	if bucket.Remaining() != 0 {
+		t.Errorf("remaining %d", bucket.Remaining())
+	}
+
+	bucket.mu.Lock()
+	bucket.last = bucket.last.Add(-time.Second)
+	bucket.mu.Unlock()
+	if bucket.Remaining() != 2 || !bucket.Allow() {
+		t.Error("not refilled after a second")
+	}
+}
+
+func TestCreateRateThrottles(t *testing.T) {
+	s := startServer(t, "-create-rate", "3")
+	var throttled int
+	for i := 0; i < 10; i++ {
+		res, _ := s.post(t, "/create-session", `{"name":"burst"}`)
+		switch res.StatusCode {
+		case http.StatusOK:
+		case http.StatusTooManyRequests:
+			throttled++
+		default:
+			t.Fatalf("got %d", res.StatusCode)
+		}
+	}
+	if throttled < 5 {
+		t.Errorf("only %d of 10 creates throttled", throttled)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+// Holds the last lines written to a session, oldest overwritten first. Only the manager goroutine uses it.
+type LineRing struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func NewLineRing(size int) *LineRing {
+	return &LineRing{lines: make([]string, size)}
+}
+
+func (r *LineRing) Add(line string) {
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Returns a copy of the lines, oldest first.
+func (r *LineRing) Lines() []string {
+	if !r.full {
+		return append([]string{}, r.lines[:r.next]...)
+	}
+
+	return append(append([]string{}, r.lines[r.next:]...), r.lines[:r.next]...)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLineRing(t *testing.T) {
+	ring := NewLineRing(3)
+	if lines := ring.Lines(); len(lines) != 0 {
+		t.Errorf("empty: got %q", lines)
+	}
+	for i := 1; i <= 2; i++ {
+		ring.Add(fmt.Sprint(i))
+	}
+	if got := strings.Join(ring.Lines(), ","); got != "1,2" {
+		t.Errorf("not full: got %s", got)
+	}
+	for i := 3; i <= 7; i++ {
+		ring.Add(fmt.Sprint(i))
+	}
+	if got := strings.Join(ring.Lines(), ","); got != "5,6,7" {
+		t.Errorf("wrapped: got %s", got)
+	}
+}
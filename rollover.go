@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const RolloverDaily = "daily"
+
+// When session files are rolled over: at local midnight, or every Interval.
+type RolloverSchedule struct {
+	Daily    bool
+	Interval time.Duration
+}
+
+// Parses a -rollover value, either "daily" or a duration of at least a second.
+func ParseRollover(value string) (RolloverSchedule, error) {
+	if value == RolloverDaily {
+		return RolloverSchedule{Daily: true}, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return RolloverSchedule{}, err
+	}
+	if interval < time.Second {
+		return RolloverSchedule{}, errors.New("rollover interval must be at least 1s")
+	}
+
+	return RolloverSchedule{Interval: interval}, nil
+}
+
+// Returns the first boundary after now.
+func (s RolloverSchedule) Next(now time.Time) time.Time {
+	if s.Daily {
+		year, month, day := now.Date()
+		return time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	}
+
+	return now.Truncate(s.Interval).Add(s.Interval)
+}
+
+// Returns the suffix for a file rolled at boundary, naming the period that just ended.
+func (s RolloverSchedule) Suffix(boundary time.Time) string {
+	if s.Daily {
+		return boundary.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+
+	return boundary.Add(-s.Interval).Format("2006-01-02T15:04:05")
+}
+
+// Sends each boundary as it passes.
+func (s RolloverSchedule) Ticks() <-chan time.Time {
+	ticks := make(chan time.Time)
+	go func() {
+		for {
+			boundary := s.Next(time.Now())
+			time.Sleep(time.Until(boundary))
+			ticks <- boundary
+		}
+	}()
+
+	return ticks
+}
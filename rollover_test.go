@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRollover(t *testing.T) {
+	if schedule, err := ParseRollover("daily"); err != nil || !schedule.Daily {
+		t.Errorf("daily: got %+v, %v", schedule, err)
+	}
+	if schedule, err := ParseRollover("1h"); err != nil || schedule.Interval != time.Hour {
+		t.Errorf("1h: got %+v, %v", schedule, err)
+	}
+	for _, value := range []string{"500ms", "weekly"} {
+		if _, err := ParseRollover(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestRolloverBoundaries(t *testing.T) {
+	now := time.Date(2026, 10, 14, 13, 45, 10, 0, time.UTC)
+	daily := RolloverSchedule{Daily: true}
+	if next := daily.Next(now); !next.Equal(time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("daily next: got %s", next)
+	}
+	if suffix := daily.Suffix(daily.Next(now)); suffix != "2026-10-14" {
+		t.Errorf("daily suffix: got %s", suffix)
+	}
+
+	hourly := RolloverSchedule{Interval: time.Hour}
+	if next := hourly.Next(now); !next.Equal(time.Date(2026, 10, 14, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("hourly next: got %s", next)
+	}
+	if suffix := hourly.Suffix(hourly.Next(now)); suffix != "2026-10-14T13:00:00" {
+		t.Errorf("hourly suffix: got %s", suffix)
+	}
+}
+
+func TestRolloverProducesTwoFiles(t *testing.T) {
+	s := startServer(t, "-rollover", "1s")
+	session := s.create(t, `{"name":"rolled"}`)
+	s.write(t, session.Id, "before")
+	base := filepath.Base(session.Filepath)
+
+	var rolled string
+	eventually(t, 5*time.Second, func() bool {
+		for _, name := range listDir(t, s.Dir) {
+			if strings.HasPrefix(name, base+".") {
+				rolled = name
+				return true
+			}
+		}
+		return false
+	})
+	s.write(t, session.Id, "after")
+
+	if lines := readLines(t, filepath.Join(s.Dir, rolled)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: before") {
+		t.Errorf("rolled file: got %q", lines)
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: after") {
+		t.Errorf("fresh file: got %q", lines)
+	}
+}
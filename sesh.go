@@ -1,219 +1,3932 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
 type MessageAndStatus struct {
-	Message string
-	Status  uint
+	Message string `json:"message"`
+	Status  uint   `json:"status"`
 }
 
 type CreateSessionRequest struct {
-	Name *string
+	// May contain {seq}, {date} and {uuid8}, expanded when the session is created
+	Name   *string           `json:"name"`
+	Tags   map[string]string `json:"tags"`
+	Format *string           `json:"format"`
+	// Directory to create the session's file in instead of -log-dir. Must be within -allowed-dirs.
+	Dir *string `json:"dir"`
+	// Fail with 409 Conflict if the session's file already exists. The file is created immediately.
+	FailIfExists *bool `json:"fail_if_exists"`
+	// Identity of the creating client, taken from the request rather than the body
+	Owner string `json:"-"`
+	// Open session this one is a subtask of
+	ParentId *uuid.UUID `json:"parent_id"`
+	// Drop writes with a Level below this one
+	MinLevel *string `json:"min_level"`
+	// Write lines to the server's stdout only. No file is created and the session can't be read back
+	Ephemeral *bool `json:"ephemeral"`
+	// Charset of the session's file, utf8 by default. Ephemeral sessions are always written to stdout as utf8
+	Charset *string `json:"charset"`
+	// Skip a write identical to the previous one if it comes within -dedupe-window
+	Dedupe *bool `json:"dedupe"`
+	// Return the oldest open session with this name and owner, if there is one, instead of creating another.
+	// Newly created sessions are then answered with 201 Created
+	CreateIfNotExists *bool `json:"create_if_not_exists"`
+	// Base URL of another sesh server, and the id of a session on it, to mirror each write to
+	ForwardTo *string    `json:"forward_to"`
+	ForwardId *uuid.UUID `json:"forward_id"`
 }
 
 type CreateSessionResponse struct {
-	Id uuid.UUID
+	Id uuid.UUID `json:"id"`
+	// Only set with -lease
+	LeaseToken string `json:"lease_token,omitempty"`
+}
+
+// A created session, with the lease token that only its creator is given.
+type CreatedSession struct {
+	Session
+	LeaseToken string `json:"lease_token,omitempty"`
+}
+
+type CreateSessionResult struct {
+	Session    Session
+	LeaseToken string
+	// Set when create_if_not_exists found an open session rather than creating one
+	Existing bool
+	Message  string
+	Status   uint
+}
+
+type RenewSessionRequest struct {
+	Id         *uuid.UUID `json:"id"`
+	LeaseToken *string    `json:"lease_token"`
+}
+
+type RenewSessionResult struct {
+	Message     string    `json:"message"`
+	Status      uint      `json:"status"`
+	LeaseExpiry time.Time `json:"lease_expiry"`
 }
 
 type CloseSessionRequest struct {
-	Id *uuid.UUID
+	Id *uuid.UUID `json:"id"`
+	// Treat closing an unknown or already closed id as success. Also set by the 'idempotent=true' query parameter.
+	Idempotent bool `json:"idempotent"`
+	// Written as the session's last line before it is closed
+	FinalContent *string `json:"final_content"`
+	// Required with FinalContent and -lease. Also read from the X-Lease-Token header
+	LeaseToken *string `json:"lease_token"`
 }
 
 type CloseSessionResponse MessageAndStatus
 
 type WriteSessionRequest struct {
-	Id      *uuid.UUID
-	Content *string
+	Id        *uuid.UUID             `json:"id"`
+	Content   *string                `json:"content"`
+	Fields    map[string]interface{} `json:"fields"`
+	Timestamp *time.Time             `json:"timestamp"`
+	// Written as the 'level' field. Lines below the session's MinLevel are dropped
+	Level *string `json:"level"`
+	// Required with -lease. Also read from the X-Lease-Token header
+	LeaseToken *string `json:"lease_token"`
+}
+
+type WriteSessionResponse struct {
+	Message string `json:"message"`
+	Status  uint   `json:"status"`
+	// Time the line was written with, formatted as RFC3339Nano
+	Timestamp string `json:"timestamp"`
+	// Set when the line was below the session's MinLevel and not written
+	Skipped bool `json:"skipped"`
+}
+
+type StreamSessionResponse struct {
+	Lines int `json:"lines"`
+	// Also sent in the X-Write-Id header. Running streams are listed at /writes
+	WriteId uuid.UUID `json:"write_id"`
+}
+
+type ReplaySessionRequest struct {
+	SourceId *uuid.UUID `json:"source_id"`
+	TargetId *uuid.UUID `json:"target_id"`
+	// Replays with the recorded gaps between lines divided by Speed. Unset or 0 replays as fast as possible.
+	Speed *float64 `json:"speed"`
+}
+
+type ReplaySessionResponse struct {
+	Lines int `json:"lines"`
+}
+
+type MoveSessionRequest struct {
+	Id  *uuid.UUID `json:"id"`
+	Dir *string    `json:"dir"`
+}
+
+type MoveSessionResponse MessageAndStatus
+
+type PauseSessionRequest struct {
+	Id *uuid.UUID `json:"id"`
+	// Set by the endpoint, /pause-session or /resume-session
+	Paused bool `json:"-"`
+}
+
+type PauseSessionResponse MessageAndStatus
+
+type RotateSessionRequest struct {
+	Id *uuid.UUID `json:"id"`
+}
+
+type UpdateTagsRequest struct {
+	Id *uuid.UUID `json:"id"`
+	// With mode=merge, a null value deletes the tag
+	Tags map[string]*string `json:"tags"`
+	// TagsMerge or TagsReplace, set from the 'mode' query parameter
+	Mode string `json:"-"`
+}
+
+type UpdateTagsResponse struct {
+	Message string            `json:"message"`
+	Status  uint              `json:"status"`
+	Tags    map[string]string `json:"tags"`
+}
+
+type RotateSessionResponse struct {
+	Message string `json:"message"`
+	Status  uint   `json:"status"`
+	// Where the session's previous file now is
+	RotatedPath string `json:"rotated_path"`
+}
+
+type CloseByTagRequest struct {
+	Tag *string `json:"tag"`
+}
+
+type CloseByTagResponse struct {
+	Count int         `json:"count"`
+	Ids   []uuid.UUID `json:"ids"`
+}
+
+type Session struct {
+	Id           uuid.UUID         `json:"id"`
+	Name         string            `json:"name"`
+	CreationTime string            `json:"creation_time"`
+	Filepath     string            `json:"filepath"`
+	Tags         map[string]string `json:"tags"`
+	Format       string            `json:"format"`
+	Seq          uint64            `json:"seq"`
+	LastActivity time.Time         `json:"last_activity"`
+	Lines        uint64            `json:"lines"`
+	Bytes        uint64            `json:"bytes"`
+	Owner        string            `json:"owner"`
+	ParentId     *uuid.UUID        `json:"parent_id"`
+	MinLevel     string            `json:"min_level"`
+	// When the lease on writing to the session runs out. Only set with -lease
+	LeaseExpiry *time.Time `json:"lease_expiry"`
+	Ephemeral   bool       `json:"ephemeral"`
+	// Writes are rejected, or dropped with -drop-paused-writes, until resumed
+	Paused    bool       `json:"paused"`
+	Charset   string     `json:"charset"`
+	ForwardTo string     `json:"forward_to"`
+	ForwardId *uuid.UUID `json:"forward_id"`
+	Dedupe    bool       `json:"dedupe"`
+	// Written to numbered files of at most -shard-size bytes, in a directory of their own. Filepath is the current one
+	Sharded bool `json:"sharded"`
+
+	writeErrors []WriteError
+	unsynced    bool
+	leaseToken  string
+	// Bytes written to the current file, which is started afresh by rotation and rollover
+	fileBytes uint64
+	// Index of the current shard, with Sharded
+	shard int
+	// Last lines written, with -memory-tail
+	recent *LineRing
+	// WriteHash of the last write and when it was made, with Dedupe
+	lastHash   uint64
+	lastHashAt time.Time
+	// Closed when a write abandoned by -write-deadline returns. Until then the session takes no other writes
+	abandoned <-chan struct{}
+}
+
+// Returns a copy of the session that shares no mutable state with the original, so it can safely leave the manager.
+func (s Session) Copy() Session {
+	if s.Tags != nil {
+		tags := make(map[string]string, len(s.Tags))
+		for k, v := range s.Tags {
+			tags[k] = v
+		}
+		s.Tags = tags
+	}
+	s.writeErrors = append([]WriteError(nil), s.writeErrors...)
+
+	return s
+}
+
+type WriteError struct {
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+type SessionErrorsResult struct {
+	Exists bool
+	Errors []WriteError
+}
+
+type ListWriteErrors struct {
+	Errors []WriteError `json:"errors"`
+}
+
+type SessionStat struct {
+	Id       uuid.UUID `json:"id"`
+	Filepath string    `json:"filepath"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Lines    uint64    `json:"lines"`
+	Bytes    uint64    `json:"bytes"`
+}
+
+// Byte offset of the end of a session's file, to pass to /read-session?offset=.
+type SessionOffset struct {
+	Id     uuid.UUID `json:"id"`
+	Offset int64     `json:"offset"`
+}
+
+type RecentSession struct {
+	Id uuid.UUID `json:"id"`
+	// Oldest first, at most -memory-tail of them
+	Lines []string `json:"lines"`
+	// Set when the session isn't open, in which case Lines is empty
+	Exists bool `json:"-"`
+}
+
+type SessionSince struct {
+	Id  uuid.UUID `json:"id"`
+	Seq uint64    `json:"seq"`
+	// Writes with a sequence number greater than the one asked for
+	Count uint64 `json:"count"`
+	// Only set with 'lines=true'
+	Lines []string `json:"lines,omitempty"`
+}
+
+type CompactSessionResponse struct {
+	Id      uuid.UUID `json:"id"`
+	Removed int       `json:"removed"`
+}
+
+type WhoAmIResponse struct {
+	// Hashed for bearer tokens, empty for anonymous clients
+	Identity      string `json:"identity"`
+	SessionsOwned int    `json:"sessions_owned"`
+	// Creates left in the -create-rate bucket, shared by all clients. Null without -create-rate
+	CreatesRemaining *int `json:"creates_remaining"`
+}
+
+type SessionLookup struct {
+	Exists  bool
+	Closed  bool
+	Session Session
+}
+
+// A session including the internal fields the manager keeps about it.
+type DebugSession struct {
+	Session
+	WriteErrors []WriteError `json:"write_errors"`
+	Unsynced    bool         `json:"unsynced"`
+}
+
+// Snapshot of the manager's internal state, served by /debug/sessions.
+type DebugState struct {
+	Sessions       []DebugSession `json:"sessions"`
+	ClosedSessions []Session      `json:"closed_sessions"`
+	NameCounts     map[string]int `json:"name_counts"`
+	AutoNamed      int            `json:"auto_named"`
+}
+
+type ListSession struct {
+	Sessions []Session `json:"sessions"`
+	// Cursor for the next page with ?limit=, empty on the last page
+	Next string `json:"next,omitempty"`
+	// Last line of each session's file by id, with ?preview=true
+	Previews map[uuid.UUID]string `json:"previews,omitempty"`
+}
+
+// Closes both the gzip reader and the underlying file.
+type GzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g GzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// A flag that may be repeated, compiling each value as a regular expression.
+type RegexpList []*regexp.Regexp
+
+func (l *RegexpList) String() string {
+	patterns := make([]string, len(*l))
+	for i, pattern := range *l {
+		patterns[i] = pattern.String()
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (l *RegexpList) Set(value string) error {
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, pattern)
+	return nil
+}
+
+// Fields available to the line template.
+type LineData struct {
+	Time        string
+	Seq         uint64
+	Content     string
+	SessionId   string
+	SessionName string
+}
+
+// Log levels from least to most severe.
+var LogLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// Returns a level's position in LogLevels, ignoring case. "warning" is accepted for "warn".
+func LevelRank(level string) (int, bool) {
+	level = strings.ToLower(level)
+	if level == "warning" {
+		level = "warn"
+	}
+	for rank, name := range LogLevels {
+		if name == level {
+			return rank, true
+		}
+	}
+
+	return 0, false
+}
+
+// Splits a 'key=value' tag selector. Returns 'false' if the selector is malformed.
+func ParseTag(tag string) (string, string, bool) {
+	key, value, found := strings.Cut(tag, "=")
+	if !found || key == "" {
+		return "", "", false
+	}
+
+	return key, value, true
+}
+
+const DefaultLineTemplate = "{{.Time}} [{{.Seq}}] Log: {{.Content}}"
+
+// Line template used by -no-timestamp, writing only the content.
+const RawLineTemplate = "{{.Content}}"
+
+// Matches the sequence number in lines written with DefaultLineTemplate.
+var TextSeqPattern = regexp.MustCompile(`^\S+ \[(\d+)\] Log: `)
+
+// Matches the placeholders expanded in session names, written {seq} or {{seq}}.
+var NamePlaceholderPattern = regexp.MustCompile(`\{\{?(seq|date|uuid8)\}\}?`)
+
+// Media types /read-session?content-type= may serve a session's log as. Anything a browser would render, like
+// text/html, would let written content run as script on sesh's origin.
+var ReadContentTypes = []string{"text/plain", "application/x-ndjson", "application/json", "application/octet-stream"}
+
+// Characters replaced when a session name is used as a download filename.
+var UnsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Matches the file names sesh creates: '<name>-<RFC3339 time>-<id prefix>', optionally rolled over and gzipped.
+var SessionFilePattern = regexp.MustCompile(`^.+-\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})-[0-9a-f]{8}(\.[0-9T:.-]+)?(\.gz)?$`)
+
+// Flags whose values are redacted from /config.
+var SecretFlags = map[string]bool{
+	// May carry credentials
+	"webhook-url": true,
+	"hmac-secret": true,
+}
+
+const Redacted = "[redacted]"
+
+// Longest line accepted by /stream-session, unless -max-line-length is larger.
+const MaxStreamLineBytes = 1 << 20
+
+const ManagerUnavailable = "Session manager did not respond in time"
+
+// How /update-tags changes a session's tags.
+const (
+	TagsMerge   = "merge"
+	TagsReplace = "replace"
+)
+
+const (
+	MaxTagKeyLength   = 64
+	MaxTagValueLength = 256
+)
+
+// Matches the tag keys /update-tags accepts.
+var TagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Behaviours for content longer than -max-line-length.
+const (
+	OversizeTruncate = "truncate"
+	OversizeReject   = "reject"
+)
+
+// Line endings -normalize-newlines converts content to.
+const (
+	NewlinesLF   = "lf"
+	NewlinesCRLF = "crlf"
+)
+
+const TruncatedMarker = "...[truncated]"
+
+const RedactedMarker = "***"
+
+// Session log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Checks if there's an error. Returns 'true' if error is not nil.
+func CheckError(err error) bool {
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return err == nil
+}
+
+// Sends value on ch, giving up after timeout. A timeout of 0 waits forever.
+func SendWithTimeout[T any](ch chan<- T, value T, timeout time.Duration) bool {
+	if timeout <= 0 {
+		ch <- value
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ch <- value:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Sends a request to the session manager and waits for its response, giving up on either after timeout.
+// The manager gives up on replies after the same timeout, so it can't be left blocked by a handler that gave up.
+func CallManager[Req any, Res any](req chan<- Req, res <-chan Res, value Req, timeout time.Duration) (Res, bool) {
+	var result Res
+	if !SendWithTimeout(req, value, timeout) {
+		return result, false
+	}
+	if timeout <= 0 {
+		return <-res, true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result = <-res:
+		return result, true
+	case <-timer.C:
+		return result, false
+	}
+}
+
+// Create file if it doesn't exist. If file already exists or file is created successfully, 'true' will be returned.
+func MaybeCreateFile(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		file, err := os.Create(path)
+		if err != nil {
+			return false
+		}
+		file.Close()
+	}
+
+	return true
+}
+
+// Parses the line template and renders it once against sample data so unknown fields are caught at startup.
+func ParseLineTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("line").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, LineData{}); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// Renders a single log line, always terminated by a newline.
+func FormatLine(tmpl *template.Template, data LineData) (string, error) {
+	var builder strings.Builder
+	if err := tmpl.Execute(&builder, data); err != nil {
+		return "", err
+	}
+	builder.WriteString("\n")
+
+	return builder.String(), nil
+}
+
+// Renders a single JSON log line. Fields are merged into the object, but cannot override 'time', 'seq' or 'content'.
+func FormatJSONLine(now string, seq uint64, content string, fields map[string]interface{}) (string, error) {
+	object := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		object[k] = v
+	}
+	object["time"] = now
+	object["seq"] = seq
+	object["content"] = content
+
+	line, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+
+	return string(line) + "\n", nil
+}
+
+// Appends fields to text content as space separated 'key=value' pairs, sorted by key.
+func AppendFields(content string, fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteString(content)
+	for _, k := range keys {
+		fmt.Fprintf(&builder, " %s=%v", k, fields[k])
+	}
+
+	return builder.String()
+}
+
+// Truncates content to at most 'max' bytes without splitting a UTF-8 sequence, and appends the truncation marker.
+func TruncateContent(content string, max int) string {
+	cut := max
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+
+	return content[:cut] + TruncatedMarker
+}
+
+// Formats a line according to the session's format.
+func FormatSessionLine(tmpl *template.Template, session Session, now string, seq uint64, content string, fields map[string]interface{}) (string, error) {
+	if session.Format == FormatJSON {
+		return FormatJSONLine(now, seq, content, fields)
+	}
+
+	return FormatLine(tmpl, LineData{
+		Time:        now,
+		Seq:         seq,
+		Content:     AppendFields(content, fields),
+		SessionId:   session.Id.String(),
+		SessionName: session.Name,
+	})
+}
+
+// Appends a line to the file at path, creating the file if it doesn't exist.
+// The file is opened and closed on every call, so open sessions never hold file descriptors.
+func AppendToFile(path string, line string, sync bool) error {
+	if !MaybeCreateFile(path) {
+		return errors.New("File could not be created")
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, fs.ModeAppend)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(line); err != nil {
+		return err
+	}
+	if sync {
+		file.Sync()
+	}
+
+	return nil
 }
 
-type WriteSessionResponse MessageAndStatus
+// Checks if a write error is likely to succeed when retried.
+func IsTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// Calls write, retrying transient failures up to retries times with a backoff that doubles after each attempt.
+func RetryTransient(retries int, backoff time.Duration, write func() error) error {
+	err := write()
+	for attempt := 0; attempt < retries && err != nil && IsTransient(err); attempt++ {
+		time.Sleep(backoff << attempt)
+		err = write()
+	}
+
+	return err
+}
+
+// Calls AppendToFile with RetryTransient.
+func AppendWithRetry(path string, line string, sync bool, retries int, backoff time.Duration) error {
+	return RetryTransient(retries, backoff, func() error { return AppendToFile(path, line, sync) })
+}
+
+// Returned when a write takes longer than -write-deadline.
+var ErrWriteDeadline = errors.New("write deadline exceeded")
+
+// Returned for a write to a session whose last write was abandoned by -write-deadline and hasn't yet returned.
+var ErrWriteInProgress = errors.New("an earlier write is still in progress")
+
+// Runs write, giving up with ErrWriteDeadline after deadline. An abandoned write carries on in the background and may
+// still land; done is closed when it returns. A deadline of 0 waits for as long as the write takes.
+func WithDeadline(deadline time.Duration, write func() error) (done <-chan struct{}, err error) {
+	finished := make(chan struct{})
+	if deadline <= 0 {
+		err = write()
+		close(finished)
+		return finished, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- write()
+		close(finished)
+	}()
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return finished, err
+	case <-timer.C:
+		return finished, ErrWriteDeadline
+	}
+}
+
+// Appends an error to the history, dropping the oldest entries beyond limit.
+func RecordWriteError(history []WriteError, entry WriteError, limit int) []WriteError {
+	if limit <= 0 {
+		return nil
+	}
+
+	history = append(history, entry)
+	if len(history) > limit {
+		history = append([]WriteError(nil), history[len(history)-limit:]...)
+	}
+
+	return history
+}
+
+// Reads newline-delimited JSON. Returns the parsed lines and the number of malformed lines skipped.
+func ReadJSONLines(r io.Reader) ([]json.RawMessage, int, error) {
+	lines := []json.RawMessage{}
+	skipped := 0
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if json.Valid(trimmed) {
+				lines = append(lines, json.RawMessage(trimmed))
+			} else {
+				skipped++
+			}
+		}
+		if err == io.EOF {
+			return lines, skipped, nil
+		}
+		if err != nil {
+			return nil, skipped, err
+		}
+	}
+}
+
+// Gzips the file at path to '<path>.gz' and removes the original once the compressed file is complete.
+func CompressFile(path string) error {
+	source, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing was ever written
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	partial := path + ".gz.tmp"
+	target, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = target.Sync()
+	}
+	target.Close()
+	if err == nil {
+		err = os.Rename(partial, path+".gz")
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Rewrites a file without its blank lines, and with dedupe without repeats of earlier writes. Writes are compared by
+// the content and fields ReplayContent recovers, so their times and sequence numbers don't make them differ, and with
+// framed, text content spanning several lines is compared and removed as a whole. Returns the number of lines removed.
+func CompactFile(path string, dedupe bool, format string, framed bool) (int, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	partial := path + ".compact.tmp"
+	target, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	seen := make(map[[sha256.Size]byte]bool)
+	// Lines of the write being read, kept until the line starting the next one
+	var write []string
+	writer := bufio.NewWriter(target)
+	flush := func() error {
+		if len(write) == 0 {
+			return nil
+		}
+		lines := write
+		write = nil
+		if dedupe {
+			content, fields := ReplayContent([]byte(strings.Join(lines, "")), format, framed)
+			encoded, _ := json.Marshal(fields)
+			sum := sha256.Sum256([]byte(content + "\x00" + string(encoded)))
+			if seen[sum] {
+				removed += len(lines)
+				return nil
+			}
+			seen[sum] = true
+		}
+		for _, line := range lines {
+			if _, err := writer.WriteString(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	reader := bufio.NewReader(source)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			err = readErr
+			break
+		}
+		if strings.TrimSpace(line) != "" {
+			if format == FormatJSON || !framed || TextSeqPattern.MatchString(line) {
+				if err = flush(); err != nil {
+					break
+				}
+			}
+			write = append(write, line)
+		} else if line != "" {
+			removed++
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = target.Sync()
+	}
+	target.Close()
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// Opens a session's log file for reading. Falls back to the gzipped copy of a compressed file.
+func OpenLogFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+
+	compressed, gzErr := os.Open(path + ".gz")
+	if gzErr != nil {
+		return nil, err
+	}
+	reader, gzErr := gzip.NewReader(compressed)
+	if gzErr != nil {
+		compressed.Close()
+		return nil, gzErr
+	}
+
+	return GzipFile{reader, compressed}, nil
+}
+
+// Deletes session files under dir last modified before cutoff, skipping any path in 'open'. A sharded session's
+// directory is deleted as a whole once its newest shard is older than cutoff. Returns the deleted paths.
+func SweepOldFiles(dir string, cutoff time.Time, open map[string]bool) []string {
+	var deleted []string
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() && path != dir && SessionFilePattern.MatchString(entry.Name()) {
+			shards, _ := ShardPaths(path)
+			if len(shards) == 0 {
+				return nil
+			}
+			if !open[path] && NewestModTime(shards).Before(cutoff) {
+				if err := os.RemoveAll(path); err != nil {
+					log.Printf("Could not delete %s: %s", path, err.Error())
+				} else {
+					deleted = append(deleted, path)
+				}
+			}
+			return fs.SkipDir
+		}
+		if err != nil || entry.IsDir() || !SessionFilePattern.MatchString(entry.Name()) {
+			return nil
+		}
+		if open[path] || open[strings.TrimSuffix(path, ".gz")] {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Could not delete %s: %s", path, err.Error())
+			return nil
+		}
+		deleted = append(deleted, path)
+		return nil
+	})
+
+	return deleted
+}
+
+// Collects the effective value of every flag, redacting secrets.
+func EffectiveConfig() map[string]string {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if SecretFlags[f.Name] && f.Value.String() != "" {
+			config[f.Name] = Redacted
+		} else {
+			config[f.Name] = f.Value.String()
+		}
+	})
+
+	return config
+}
+
+// Matches the suffix of a rolled over copy of a session file, optionally gzipped.
+var BackupSuffixPattern = regexp.MustCompile(`^\.[0-9T:.-]+(\.gz)?$`)
+
+// Deletes all but the newest keep rolled over copies of the session file at path. Returns the deleted paths.
+func PruneBackups(path string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	base := filepath.Base(path)
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), base)
+		if entry.IsDir() || suffix == entry.Name() || !BackupSuffixPattern.MatchString(suffix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			backups = append(backups, backup{filepath.Join(filepath.Dir(path), entry.Name()), info.ModTime()})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].modTime.Equal(backups[j].modTime) {
+			return backups[i].modTime.After(backups[j].modTime)
+		}
+		return backups[i].path > backups[j].path
+	})
+
+	var deleted []string
+	for i := keep; i < len(backups); i++ {
+		if err := os.Remove(backups[i].path); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, backups[i].path)
+	}
+
+	return deleted, nil
+}
+
+// Resolves a directory to an absolute path with symlinks evaluated, so it can be compared against an allowlist.
+func ResolveDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return resolved, nil
+}
+
+// Resolves a comma separated list of directories.
+func ParseDirList(list string) ([]string, error) {
+	var dirs []string
+	for _, dir := range strings.Split(list, ",") {
+		if dir = strings.TrimSpace(dir); dir == "" {
+			continue
+		}
+		resolved, err := ResolveDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, resolved)
+	}
+
+	return dirs, nil
+}
+
+// Checks a directory can be written to by creating and removing a temporary file in it.
+func CheckWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".sesh-write-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	return os.Remove(file.Name())
+}
+
+// Checks if the resolved dir is one of, or nested under one of, the allowed dirs.
+func IsWithinDirs(dir string, allowed []string) bool {
+	for _, root := range allowed {
+		rel, err := filepath.Rel(root, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks that path is relative and doesn't climb out of its parent with '..'.
+func IsRelativeSubpath(path string) bool {
+	if path == "" || filepath.IsAbs(path) {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Moves a file, falling back to copy and remove when source and target are on different filesystems.
+func MoveFile(source string, target string) error {
+	err := os.Rename(source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	return os.Remove(source)
+}
+
+// Creates an empty file at path, failing with fs.ErrExist if one is already there.
+func CreateNewFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// Flushes a file's contents to stable storage.
+func SyncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// Turns a recorded line back into write content, leaving out what sesh added when writing it. JSON lines are unpacked
+// into their content and fields. Text lines lose their checksum, and with framed, the time and sequence number
+// DefaultLineTemplate puts before the content; other text lines are replayed whole.
+func ReplayContent(line []byte, format string, framed bool) (string, map[string]interface{}) {
+	line = bytes.TrimRight(line, "\r\n")
+	if format == FormatJSON {
+		var object map[string]interface{}
+		if json.Unmarshal(line, &object) == nil {
+			content, _ := object["content"].(string)
+			delete(object, "content")
+			delete(object, "time")
+			delete(object, "seq")
+			delete(object, ChecksumField)
+			return content, object
+		}
+	}
+
+	content := string(line)
+	if _, valid := VerifyLine(content, FormatText); valid {
+		content = TextChecksumPattern.FindStringSubmatch(content)[1]
+	}
+	if framed {
+		if prefix := TextSeqPattern.FindString(content); prefix != "" {
+			content = content[len(prefix):]
+		}
+	}
+
+	return content, nil
+}
+
+// Returns the sequence number of a line written with the json format or DefaultLineTemplate. ok is false for lines that
+// don't start a write, like the rest of multi-line content.
+func LineSeq(line string, format string) (seq uint64, ok bool) {
+	if format == FormatJSON {
+		var object struct {
+			Seq *uint64 `json:"seq"`
+		}
+		if json.Unmarshal([]byte(line), &object) != nil || object.Seq == nil {
+			return 0, false
+		}
+		return *object.Seq, true
+	}
+
+	match := TextSeqPattern.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(match[1], 10, 64)
+
+	return seq, err == nil
+}
+
+// Returns the lines read from r that were written after seq, including continuation lines of those writes.
+func LinesSince(r io.Reader, format string, seq uint64) ([]string, error) {
+	lines := []string{}
+	after := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MaxStreamLineBytes)
+	for scanner.Scan() {
+		if lineSeq, ok := LineSeq(scanner.Text(), format); ok {
+			after = lineSeq > seq
+		}
+		if after {
+			lines = append(lines, scanner.Text())
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// Checks tag keys are short and made of letters, digits, '.', '_' and '-', and that values are short UTF-8 strings.
+// Null values, which delete a tag, are only allowed when deleting is.
+func ValidateTags(tags map[string]*string, allowDelete bool) error {
+	for key, value := range tags {
+		if len(key) > MaxTagKeyLength || !TagKeyPattern.MatchString(key) {
+			return fmt.Errorf("tag key %q must be at most %d letters, digits, '.', '_' or '-'", key, MaxTagKeyLength)
+		}
+		if value == nil {
+			if !allowDelete {
+				return fmt.Errorf("tag %q can only be null with mode=merge", key)
+			}
+			continue
+		}
+		if len(*value) > MaxTagValueLength || !utf8.ValidString(*value) {
+			return fmt.Errorf("tag %q must be valid UTF-8 of at most %d bytes", key, MaxTagValueLength)
+		}
+	}
+
+	return nil
+}
+
+// Converts the \r\n, \r and \n line endings in content to style. Content is returned unchanged if style is empty.
+func NormalizeNewlines(content string, style string) string {
+	if style == "" {
+		return content
+	}
+
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+	if style == NewlinesCRLF {
+		content = strings.ReplaceAll(content, "\n", "\r\n")
+	}
+
+	return content
+}
+
+// With hide, replaces each of paths in a message for a client with Redacted, as -hide-filepaths does for session file
+// paths in responses. Pass a file's path before its directory's, so the directory doesn't leave the file's name behind.
+func HidePaths(message string, hide bool, paths ...string) string {
+	if hide {
+		for _, path := range paths {
+			message = strings.ReplaceAll(message, path, Redacted)
+		}
+	}
+
+	return message
+}
+
+// Replaces every match of the patterns in content.
+func Redact(content string, patterns RegexpList) string {
+	for _, pattern := range patterns {
+		content = pattern.ReplaceAllLiteralString(content, RedactedMarker)
+	}
+
+	return content
+}
+
+// Redacts string values, including those nested in objects and arrays, returning a new map.
+func RedactFields(fields map[string]interface{}, patterns RegexpList) map[string]interface{} {
+	if len(patterns) == 0 || fields == nil {
+		return fields
+	}
+
+	redacted := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		redacted[k] = redactValue(v, patterns)
+	}
+
+	return redacted
+}
+
+func redactValue(value interface{}, patterns RegexpList) interface{} {
+	switch v := value.(type) {
+	case string:
+		return Redact(v, patterns)
+	case map[string]interface{}:
+		return RedactFields(v, patterns)
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactValue(item, patterns)
+		}
+		return redacted
+	}
+
+	return value
+}
+
+// Reports whether mediaType is one of ReadContentTypes.
+func IsReadContentType(mediaType string) bool {
+	for _, allowed := range ReadContentTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expands {seq}, {date} and {uuid8} in a session name.
+func ExpandName(name string, seq int, created time.Time, id uuid.UUID) string {
+	return NamePlaceholderPattern.ReplaceAllStringFunc(name, func(placeholder string) string {
+		switch strings.Trim(placeholder, "{}") {
+		case "seq":
+			return strconv.Itoa(seq)
+		case "date":
+			return created.Format("2006-01-02")
+		default:
+			return id.String()[:8]
+		}
+	})
+}
+
+// Checks a session name can be used in a file name without leaving its directory.
+func IsSafeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// Replaces anything but letters, digits, dots, dashes and underscores so a name is safe to use as a download filename.
+func SanitizeFilename(name string) string {
+	safe := UnsafeFilenameChars.ReplaceAllString(name, "_")
+	if strings.Trim(safe, ".") == "" {
+		return "session"
+	}
+
+	return safe
+}
+
+// Returns up to limit sessions after cursor, ordered by id, and the cursor for the page after. cursor is "" for the first page.
+func PageSessions(sessions []Session, cursor string, limit int) ([]Session, string, error) {
+	var after string
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", errors.New("Invalid cursor")
+		}
+		id, err := uuid.ParseBytes(decoded)
+		if err != nil {
+			return nil, "", errors.New("Invalid cursor")
+		}
+		after = id.String()
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id.String() < sessions[j].Id.String() })
+	start := sort.Search(len(sessions), func(i int) bool { return sessions[i].Id.String() > after })
+	page := sessions[start:]
+	if limit <= 0 || len(page) <= limit {
+		return page, "", nil
+	}
+	page = page[:limit]
+
+	return page, base64.RawURLEncoding.EncodeToString([]byte(page[limit-1].Id.String())), nil
+}
+
+// Writes everything read from r as a JSON string, a chunk at a time.
+func CopyJSONString(w io.Writer, r io.Reader) error {
+	buffer := make([]byte, 32*1024)
+	var pending []byte
+	io.WriteString(w, `"`)
+	for {
+		n, readErr := r.Read(buffer)
+		data := append(pending, buffer[:n]...)
+		end := len(data)
+		if readErr == nil {
+			// Hold back a rune split across reads so it isn't encoded as invalid
+			for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+				if utf8.RuneStart(data[i]) {
+					if !utf8.FullRune(data[i:]) {
+						end = i
+					}
+					break
+				}
+			}
+		}
+		encoded, err := json.Marshal(string(data[:end]))
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded[1 : len(encoded)-1]); err != nil {
+			return err
+		}
+		pending = append([]byte(nil), data[end:]...)
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	_, err := io.WriteString(w, `"`)
+
+	return err
+}
+
+// Stats a session's log file, falling back to the gzipped copy of a compressed file.
+func StatLogFile(path string) (fs.FileInfo, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if compressed, gzErr := os.Stat(path + ".gz"); gzErr == nil {
+			return compressed, nil
+		}
+	}
+
+	return info, err
+}
+
+// Builds an ETag from a file's size and modification time. The query is included since offsets and formats change the body.
+func LogETag(info fs.FileInfo, query string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	return fmt.Sprintf("\"%x-%x-%x\"", info.Size(), info.ModTime().UnixNano(), hash.Sum32())
+}
+
+// Hashes a write's content, level and fields, to spot one repeated.
+func WriteHash(write WriteSessionRequest) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(*write.Content))
+	if write.Level != nil {
+		hash.Write([]byte{0})
+		hash.Write([]byte(strings.ToLower(*write.Level)))
+	}
+	if len(write.Fields) > 0 {
+		// Map keys are encoded sorted, so equal fields encode the same
+		fields, _ := json.Marshal(write.Fields)
+		hash.Write([]byte{0})
+		hash.Write(fields)
+	}
+
+	return hash.Sum64()
+}
+
+// Checks an If-None-Match header against an ETag.
+func MatchesETag(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Advances reader past the first offset bytes, seeking when possible.
+func SkipTo(reader io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, reader, offset)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// Returns a reader of what follows in reader from the start of the first line matching pattern. Nothing is read if
+// no line matches.
+func ReadFromMatch(reader io.Reader, pattern *regexp.Regexp) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadString('\n')
+		if pattern.MatchString(strings.TrimRight(line, "\r\n")) {
+			return io.MultiReader(strings.NewReader(line), buffered), nil
+		}
+		if err == io.EOF {
+			return strings.NewReader(""), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Returns the last line of a file without its newline, reading backwards from the end so only the line itself is read.
+func ReadLastLine(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	const chunkSize = 4096
+	var line []byte
+	for end := info.Size(); end > 0; {
+		start := end - chunkSize
+		if start < 0 {
+			start = 0
+		}
+		chunk := make([]byte, end-start)
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return "", err
+		}
+		line = append(chunk, line...)
+		if index := bytes.LastIndexByte(bytes.TrimSuffix(line, []byte("\n")), '\n'); index >= 0 {
+			line = line[index+1:]
+			break
+		}
+		end = start
+	}
+
+	return strings.TrimSuffix(string(line), "\n"), nil
+}
+
+// Prefixes a CSV cell with ' if a spreadsheet would otherwise read it as a formula.
+func CSVCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// Writes sessions as CSV with a header row. Cells that spreadsheets would run as formulas are escaped with CSVCell.
+func WriteSessionsCSV(w io.Writer, sessions []Session) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "name", "creation_time", "filepath"})
+	for _, session := range sessions {
+		writer.Write([]string{session.Id.String(), CSVCell(session.Name), CSVCell(session.CreationTime), CSVCell(session.Filepath)})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// Returns root followed by its descendants among sessions, breadth first with siblings in creation order.
+func SessionTree(sessions []Session, root Session) []Session {
+	children := make(map[uuid.UUID][]Session)
+	for _, session := range sessions {
+		if session.ParentId != nil {
+			children[*session.ParentId] = append(children[*session.ParentId], session)
+		}
+	}
+
+	tree := []Session{root}
+	for i := 0; i < len(tree); i++ {
+		siblings := children[tree[i].Id]
+		sort.Slice(siblings, func(a, b int) bool { return siblings[a].CreationTime < siblings[b].CreationTime })
+		tree = append(tree, siblings...)
+	}
+
+	return tree
+}
+
+func main() {
+	defaultPath, osError := os.Getwd()
+	CheckError(osError)
+	logDir := flag.String("log-dir", defaultPath, "Directory to put all log files")
+	lineTemplateText := flag.String("line-template", DefaultLineTemplate, "text/template used to format each log line. Fields: .Time, .Seq, .Content, .SessionId, .SessionName")
+	noSync := flag.Bool("no-sync", false, "Skip syncing log files to disk after each write. Faster, but data may be lost on crash")
+	maxLineLength := flag.Int("max-line-length", 0, "Maximum length in bytes of a write's content. 0 disables the limit")
+	onOversize := flag.String("on-oversize", OversizeTruncate, "What to do with content longer than -max-line-length: truncate or reject")
+	errorHistory := flag.Int("error-history", 10, "Number of recent write errors to keep per session")
+	defaultName := flag.String("default-name", "", "Name to use when a create request omits one. If unset, a name is required")
+	compressOnClose := flag.Bool("compress-on-close", false, "Gzip a session's log file when it is closed")
+	syslogAddr := flag.String("syslog-addr", "", "Also send log lines to the syslog server at this address")
+	syslogNetwork := flag.String("syslog-network", "udp", "Network used to reach -syslog-addr: udp or tcp")
+	syslogOnly := flag.Bool("syslog-only", false, "Send log lines only to syslog instead of log files. Requires -syslog-addr")
+	retention := flag.Duration("retention", 0, "Delete session log files under -log-dir older than this. 0 disables cleanup")
+	sweepInterval := flag.Duration("sweep-interval", 10*time.Minute, "How often to look for files older than -retention")
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	allowedDirsList := flag.String("allowed-dirs", "", "Comma separated directories sessions may be created in or moved into, in addition to -log-dir")
+	terseResponses := flag.Bool("terse-responses", false, "Respond to create with only the session id instead of the full session")
+	idleFlush := flag.Duration("idle-flush", 0, "With -no-sync, sync a session's file once it has had no writes for this long. 0 disables")
+	managerTimeout := flag.Duration("manager-timeout", 10*time.Second, "How long a request waits on the session manager before failing with 503. 0 waits forever")
+	maxPerName := flag.Int("max-per-name", 0, "Maximum number of open sessions sharing a name. 0 disables the limit")
+	envFile := flag.String("env-file", "", "File of SESH_<FLAG>=value lines read at startup and on SIGHUP. Flags may also be set from the environment")
+	dateLayout := flag.String("date-layout", "", "Put session files in a subdirectory of -log-dir named by the creation date in this Go time layout, e.g. 2006/01/02")
+	closeFlushTimeout := flag.Duration("close-flush-timeout", 0, "How long close waits for writes already in flight to that session. 0 closes immediately")
+	var redactPatterns RegexpList
+	flag.Var(&redactPatterns, "redact-patterns", "Regular expression whose matches are replaced with *** in written content. May be repeated")
+	createRate := flag.Float64("create-rate", 0, "Maximum session creates per second across all clients. 0 disables the limit")
+	webhookURL := flag.String("webhook-url", "", "POST a JSON event to this URL whenever a session is created or closed")
+	webhookRetries := flag.Int("webhook-retries", 3, "Times to retry a failed webhook delivery")
+	webhookTimeout := flag.Duration("webhook-timeout", 5*time.Second, "Timeout for each webhook delivery attempt")
+	autoName := flag.Bool("auto-name", false, "Name sessions created without a name session-0001, session-0002, ...")
+	debug := flag.Bool("debug", false, "Serve the manager's internal state at /debug/sessions")
+	lineChecksum := flag.String("line-checksum", "", "Add a checksum of each line when it's written, using crc32 or sha256. Check them with /read-session?verify=true")
+	rolloverValue := flag.String("rollover", "", "Roll every open session's file over \"daily\" at midnight or at an interval such as 1h, renaming it with a date suffix")
+	readOnly := flag.Bool("read-only", false, "Only serve reads. Creating, writing, closing and moving sessions is rejected with 403")
+	cascadeClose := flag.Bool("cascade-close", false, "Also close a session's children, created with parent_id, when it is closed")
+	goneWindow := flag.Duration("gone-window", time.Minute, "How long after a close writes to that session fail with 410 Gone rather than 400. 0 disables")
+	noTimestamp := flag.Bool("no-timestamp", false, "Write text session lines as just their content, without the time and sequence prefix")
+	lease := flag.Duration("lease", 0, "Give each session's creator a lease token for this long. Writes must present it and fail with 409 once it expires until renewed with /renew-session. 0 disables")
+	writeRetries := flag.Int("write-retries", 2, "Times to retry a write that failed with a transient error such as EINTR or EAGAIN")
+	writeRetryBackoff := flag.Duration("write-retry-backoff", 10*time.Millisecond, "Wait before the first write retry, doubled for each one after")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS, and HTTP/2, with this certificate file. Requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file for -tls-cert")
+	keepalive := flag.Bool("keepalive", true, "Keep client connections open between requests. Saves a TCP (and TLS) handshake on every write, which dominates per-line latency for clients writing one line per request")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "How long a kept-alive connection may sit idle before it's closed. 0 keeps idle connections open indefinitely")
+	maxBackups := flag.Int("max-backups", 0, "Keep only this many rolled over copies of each session's file, deleting the oldest. 0 keeps them all")
+	logDirsList := flag.String("log-dirs", "", "Comma separated directories to spread new sessions across round-robin, instead of -log-dir")
+	hideFilepaths := flag.Bool("hide-filepaths", false, "Redact session file paths in responses and error messages")
+	dropPausedWrites := flag.Bool("drop-paused-writes", false, "Accept writes to paused sessions with 200 and drop them, instead of rejecting them with 423")
+	integrityInterval := flag.Duration("integrity-interval", 0, "How often to check that open sessions' files still exist and haven't shrunk, reported at /integrity. 0 disables")
+	strictJSON := flag.Bool("strict-json", false, "Reject request bodies with unknown fields with 400 instead of ignoring them")
+	forwardRetries := flag.Int("forward-retries", 3, "Times to retry a write that could not be forwarded to a session's forward_to server")
+	forwardTimeout := flag.Duration("forward-timeout", 5*time.Second, "Timeout for each attempt to forward a write")
+	normalizeNewlines := flag.String("normalize-newlines", "", "Convert line endings in written content to lf or crlf. Empty leaves them as sent")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to let running requests finish on SIGINT or SIGTERM")
+	maxConnections := flag.Int("max-connections", 0, "Close new connections straight away while this many are open. 0 is unlimited")
+	dedupeWindow := flag.Duration("dedupe-window", time.Second, "How soon a repeated write to a session created with dedupe is skipped as a duplicate")
+	reusePort := flag.Bool("reuse-port", false, "Set SO_REUSEPORT so a restarted sesh can bind before the old process exits. Linux only")
+	listenBacklog := flag.Int("listen-backlog", 0, "Queue at most this many connections waiting to be accepted. 0 uses the system default. Linux only")
+	auditFile := flag.String("audit-file", "", "Append a JSON record of every mutating request, with who made it and its status, to this file")
+	allowEmptyWrites := flag.Bool("allow-empty-writes", true, "Accept writes with empty content and no fields with 200 but write nothing. If false they are rejected with 400")
+	hmacSecret := flag.String("hmac-secret", "", "Sign response bodies with an HMAC-SHA256 keyed with this secret, sent in the X-Signature header")
+	shardSize := flag.Int64("shard-size", 0, "Write each session to numbered files of at most this many bytes in a directory of its own, read back as one by /read-session. 0 disables")
+	memoryTail := flag.Int("memory-tail", 0, "Keep the last this many lines of each open session in memory, served by /recent-session. 0 disables")
+	stdoutMode := flag.Bool("stdout-mode", false, "Create every session as ephemeral, writing its lines to stdout prefixed with its name and id instead of to a file")
+	writeDeadline := flag.Duration("write-deadline", 0, "Give up on a file write that takes longer than this and answer 504, leaving it to finish in the background. 0 waits")
+	statsdAddr := flag.String("statsd-addr", "", "Send session and write counters and write latency to this StatsD host:port over UDP")
+	pretty := flag.Bool("pretty", false, "Indent JSON responses by two spaces, for reading by hand")
+	onCloseCmd := flag.String("on-close-cmd", "", "Run this executable when a session is closed, with the session's filepath, id and name as its arguments")
+	onCloseTimeout := flag.Duration("on-close-timeout", 30*time.Second, "Kill an -on-close-cmd still running after this long")
+	maxClosed := flag.Int("max-closed-sessions", 10000, "Closed sessions to remember, so they can still be read, replayed and compacted by id. The oldest are forgotten first")
+	flag.Parse()
+	started := time.Now()
+
+	explicitFlags := ExplicitFlags()
+	appliedEnv, envErr := ReadEnv(*envFile)
+	CheckError(envErr)
+	CheckError(ApplyEnv(appliedEnv, explicitFlags))
+
+	if negative := NegativeFlags(); len(negative) > 0 {
+		log.Fatalf("%s can't be negative", strings.Join(negative, ", "))
+	}
+
+	if *onOversize != OversizeTruncate && *onOversize != OversizeReject {
+		log.Fatalf("-on-oversize must be %q or %q", OversizeTruncate, OversizeReject)
+	}
+	if *normalizeNewlines != "" && *normalizeNewlines != NewlinesLF && *normalizeNewlines != NewlinesCRLF {
+		log.Fatalf("-normalize-newlines must be %q or %q", NewlinesLF, NewlinesCRLF)
+	}
+
+	if *retention > 0 && *sweepInterval <= 0 {
+		log.Fatal("-sweep-interval must be positive when -retention is set")
+	}
+	if *maxClosed < 0 {
+		log.Fatal("-max-closed-sessions must not be negative")
+	}
+
+	if *idleFlush > 0 && !*noSync {
+		log.Fatal("-idle-flush only applies with -no-sync, files are otherwise synced on every write")
+	}
+
+	if *dateLayout != "" && !IsRelativeSubpath(time.Now().Format(*dateLayout)) {
+		log.Fatal("-date-layout must produce a relative path inside -log-dir")
+	}
+
+	if _, ok := ChecksumAlgorithms[*lineChecksum]; *lineChecksum != "" && !ok {
+		log.Fatal("-line-checksum must be crc32 or sha256")
+	}
+
+	var rollover RolloverSchedule
+	if *rolloverValue != "" {
+		var rolloverErr error
+		rollover, rolloverErr = ParseRollover(*rolloverValue)
+		if rolloverErr != nil {
+			log.Fatalf("Invalid -rollover: %s", rolloverErr.Error())
+		}
+	}
+
+	if *autoName && *defaultName != "" {
+		log.Fatal("-auto-name and -default-name can't be used together")
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCert != "" {
+		if _, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			log.Fatalf("Could not load -tls-cert and -tls-key: %s", err.Error())
+		}
+	}
+
+	if *webhookURL != "" {
+		if parsed, err := url.Parse(*webhookURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			log.Fatal("-webhook-url must be an http or https URL")
+		}
+	}
+
+	if *readOnly && (*retention > 0 || *rolloverValue != "") {
+		log.Fatal("-read-only can't be used with -retention or -rollover, which change files on disk")
+	}
+
+	if *readOnly {
+		fmt.Println("Running in read-only mode, sessions can't be created or changed")
+	}
+
+	if *noSync {
+		fmt.Println("WARNING: -no-sync is set, log data may be lost if the process or machine crashes")
+	}
+
+	if *noTimestamp {
+		if *lineTemplateText != DefaultLineTemplate {
+			log.Fatal("-no-timestamp and -line-template can't be used together")
+		}
+		*lineTemplateText = RawLineTemplate
+	}
+
+	lineTemplate, templateErr := ParseLineTemplate(*lineTemplateText)
+	if templateErr != nil {
+		log.Fatalf("-line-template: %s", templateErr.Error())
+	}
+
+	if *onCloseCmd != "" {
+		if _, err := exec.LookPath(*onCloseCmd); err != nil {
+			log.Fatalf("-on-close-cmd: %s", err.Error())
+		}
+	}
+
+	if *stdoutMode && (*logDirsList != "" || *shardSize > 0 || *syslogOnly) {
+		log.Fatal("-stdout-mode writes no files, so it can't be combined with -log-dirs, -shard-size or -syslog-only")
+	}
+	logDirs := []string{*logDir}
+	if *logDirsList == "" && !*syslogOnly && !*stdoutMode {
+		if err := CheckWritable(*logDir); err != nil {
+			log.Fatalf("-log-dir %s is not writable: %s", *logDir, err.Error())
+		}
+	}
+	if *logDirsList != "" {
+		var logDirsErr error
+		logDirs, logDirsErr = ParseDirList(*logDirsList)
+		CheckError(logDirsErr)
+		for _, dir := range logDirs {
+			if err := CheckWritable(dir); err != nil {
+				log.Fatalf("-log-dirs: %s is not writable: %s", dir, err.Error())
+			}
+		}
+	}
+
+	allowedDirs, dirsErr := ParseDirList(*logDir + "," + strings.Join(logDirs, ",") + "," + *allowedDirsList)
+	CheckError(dirsErr)
+
+	var syslogForwarder *SyslogForwarder
+	if *syslogAddr != "" {
+		var syslogErr error
+		syslogForwarder, syslogErr = NewSyslogForwarder(*syslogNetwork, *syslogAddr)
+		CheckError(syslogErr)
+	} else if *syslogOnly {
+		log.Fatal("-syslog-only requires -syslog-addr")
+	}
+
+	if summary := ConfigSummary(); len(summary) > 0 {
+		fmt.Printf("Starting with %s\n", strings.Join(summary, " "))
+	}
+	if *stdoutMode {
+		fmt.Printf("Listening on %s, writing sessions to stdout\n", *addr)
+	} else {
+		fmt.Printf("Listening on %s, writing sessions to %s\n", *addr, strings.Join(logDirs, ", "))
+	}
+
+	var statsd *StatsD
+	if *statsdAddr != "" {
+		var statsdErr error
+		statsd, statsdErr = NewStatsD(*statsdAddr)
+		CheckError(statsdErr)
+	}
+
+	var webhook *Webhook
+	if *webhookURL != "" {
+		webhook = NewWebhook(*webhookURL, *webhookRetries, *webhookTimeout)
+	}
+	forwarder := NewForwarder(*forwardRetries, *forwardTimeout)
+	notify := func(eventType string, session Session) {
+		if webhook != nil {
+			webhook.Notify(SessionEvent{eventType, session.Id, session.Name, time.Now().Format(time.RFC3339Nano)})
+		}
+	}
+
+	// Session related channels
+	createSessionReq := make(chan CreateSessionRequest)
+	createSessionRes := make(chan CreateSessionResult)
+	listSessionReq := make(chan bool)
+	listSessionRes := make(chan []Session)
+	closeSessionReq := make(chan CloseSessionRequest)
+	closeSessionRes := make(chan CloseSessionResponse)
+	writeSessionReq := make(chan WriteSessionRequest)
+	writeSessionRes := make(chan WriteSessionResponse)
+	moveSessionReq := make(chan MoveSessionRequest)
+	moveSessionRes := make(chan MoveSessionResponse)
+	closeByTagReq := make(chan CloseByTagRequest)
+	closeByTagRes := make(chan CloseByTagResponse)
+	sessionErrorsReq := make(chan uuid.UUID)
+	sessionErrorsRes := make(chan SessionErrorsResult)
+	getSessionReq := make(chan uuid.UUID)
+	getSessionRes := make(chan SessionLookup)
+	reloadReq := make(chan map[string]string)
+	configReq := make(chan bool)
+	configRes := make(chan map[string]string)
+	pauseSessionReq := make(chan PauseSessionRequest)
+	pauseSessionRes := make(chan PauseSessionResponse)
+	rotateSessionReq := make(chan RotateSessionRequest)
+	rotateSessionRes := make(chan RotateSessionResponse)
+	updateTagsReq := make(chan UpdateTagsRequest)
+	updateTagsRes := make(chan UpdateTagsResponse)
+	renewSessionReq := make(chan RenewSessionRequest)
+	renewSessionRes := make(chan RenewSessionResult)
+	recentSessionReq := make(chan uuid.UUID)
+	recentSessionRes := make(chan RecentSession)
+	sessionTreeReq := make(chan uuid.UUID)
+	sessionTreeRes := make(chan []Session)
+	debugReq := make(chan bool)
+	sweepNow := make(chan bool, 1)
+	debugRes := make(chan DebugState)
+
+	// Session manager
+	go func() {
+
+		sessions := make(map[uuid.UUID]Session)
+		closedSessions := make(map[uuid.UUID]Session)
+		// Ids in closedSessions, oldest first, bounded by -max-closed-sessions
+		closedOrder := []uuid.UUID{}
+		// Close times within -gone-window, pruned as sessions are closed
+		recentlyClosed := make(map[uuid.UUID]time.Time)
+		nameCounts := make(map[string]int)
+		// Open session ids by name, oldest first
+		namedSessions := make(map[string][]uuid.UUID)
+		// Last {seq} used for each name template
+		nameSequences := make(map[string]int)
+		autoNamed := 0
+		// Sessions placed in logDirs, to pick the next one round-robin
+		placed := 0
+
+		var idleFlushTick <-chan time.Time
+		if *idleFlush > 0 {
+			idleFlushTick = time.NewTicker(*idleFlush / 2).C
+		}
+		var rolloverTick <-chan time.Time
+		if *rolloverValue != "" {
+			rolloverTick = rollover.Ticks()
+		}
+
+		// Closes a session, and with -cascade-close its descendants first. Returns the ids of the descendants closed.
+		var endSession func(session Session) []uuid.UUID
+		endSession = func(session Session) []uuid.UUID {
+			var cascaded []uuid.UUID
+			if *cascadeClose {
+				for _, child := range sessions {
+					if child.ParentId != nil && *child.ParentId == session.Id {
+						cascaded = append(append(cascaded, endSession(child)...), child.Id)
+					}
+				}
+			}
+			if session.unsynced {
+				SyncFile(session.Filepath)
+			}
+			delete(sessions, session.Id)
+			if nameCounts[session.Name]--; nameCounts[session.Name] <= 0 {
+				delete(nameCounts, session.Name)
+			}
+			for i, id := range namedSessions[session.Name] {
+				if id == session.Id {
+					namedSessions[session.Name] = append(namedSessions[session.Name][:i:i], namedSessions[session.Name][i+1:]...)
+					break
+				}
+			}
+			if len(namedSessions[session.Name]) == 0 {
+				delete(namedSessions, session.Name)
+			}
+			// Only open sessions are served from memory or keep their write errors
+			session.recent = nil
+			session.writeErrors = nil
+			closedSessions[session.Id] = session
+			closedOrder = append(closedOrder, session.Id)
+			for len(closedOrder) > 0 && len(closedOrder) > *maxClosed {
+				delete(closedSessions, closedOrder[0])
+				closedOrder = closedOrder[1:]
+			}
+			SessionsOpen.Add(-1)
+			SessionsClosed.Add(1)
+			statsd.Count("session.closed", 1)
+			if *goneWindow > 0 {
+				now := time.Now()
+				for id, closedAt := range recentlyClosed {
+					if now.Sub(closedAt) > *goneWindow {
+						delete(recentlyClosed, id)
+					}
+				}
+				recentlyClosed[session.Id] = now
+			}
+			notify(EventClosed, session)
+			compress := *compressOnClose && !session.Ephemeral && !session.Sharded
+			if compress || *onCloseCmd != "" {
+				go func() {
+					path := session.Filepath
+					if compress {
+						if err := CompressFile(path); err != nil {
+							log.Printf("Could not compress %s: %s", path, err.Error())
+						} else if _, err := os.Stat(path + ".gz"); err == nil {
+							path += ".gz"
+						}
+					}
+					if session.Sharded {
+						// The shards are all in the session's directory
+						path = filepath.Dir(path)
+					}
+					if *onCloseCmd != "" {
+						if err := RunHook(*onCloseCmd, *onCloseTimeout, path, session.Id.String(), session.Name); err != nil {
+							log.Printf("-on-close-cmd failed for %s: %s", session.Id.String(), err.Error())
+						}
+					}
+				}()
+			}
+
+			return cascaded
+		}
+
+		// Renames a session's file to '<file>.<suffix>' and starts a fresh one. Writes are handled by this goroutine, so none
+		// can land in between.
+		rollFile := func(id uuid.UUID, suffix string) (string, error) {
+			session := sessions[id]
+			if session.unsynced {
+				SyncFile(session.Filepath)
+				session.unsynced = false
+				sessions[id] = session
+			}
+			target := session.Filepath + "." + suffix
+			if err := os.Rename(session.Filepath, target); err != nil {
+				return "", err
+			}
+			MaybeCreateFile(session.Filepath)
+			session.fileBytes = 0
+			sessions[id] = session
+			fmt.Printf("Rolled over %s to %s\n", session.Filepath, target)
+			if *maxBackups > 0 {
+				deleted, err := PruneBackups(session.Filepath, *maxBackups)
+				if err != nil {
+					log.Printf("Could not delete old copies of %s: %s", session.Filepath, err.Error())
+				}
+				for _, path := range deleted {
+					fmt.Printf("Deleted %s, more than -max-backups=%d\n", path, *maxBackups)
+				}
+			}
+
+			return target, nil
+		}
+
+		// Formats a line and appends it to the session's file, or stdout for ephemeral sessions. The returned session has
+		// its counters updated, or the error recorded.
+		appendLine := func(session Session, now string, content string, fields map[string]interface{}) (Session, error) {
+			content = NormalizeNewlines(content, *normalizeNewlines)
+			logStatement, err := FormatSessionLine(lineTemplate, session, now, session.Seq+1, content, fields)
+			if err == nil && *lineChecksum != "" {
+				logStatement, err = AddChecksum(logStatement, session.Format, *lineChecksum)
+			}
+			if err == nil && session.Ephemeral {
+				fmt.Printf("[%s %s] %s", session.Name, session.Id.String()[:8], logStatement)
+			} else if err == nil && !*syslogOnly {
+				if session.abandoned != nil {
+					select {
+					case <-session.abandoned:
+						session.abandoned = nil
+					default:
+						// Appending alongside it could interleave the two lines
+						return session, ErrWriteInProgress
+					}
+				}
+				encoded := EncodeLine(logStatement, session.Charset, session.Filepath)
+				if session.Sharded && session.fileBytes > 0 && session.fileBytes+uint64(len(encoded)) > uint64(*shardSize) {
+					// Lines aren't split, so a shard is only larger than -shard-size if a single line is
+					if session.unsynced {
+						SyncFile(session.Filepath)
+						session.unsynced = false
+					}
+					session.shard++
+					session.Filepath = ShardPath(filepath.Dir(session.Filepath), session.shard)
+					session.fileBytes = 0
+					encoded = EncodeLine(logStatement, session.Charset, session.Filepath)
+				}
+				path := session.Filepath
+				writeStarted := time.Now()
+				var done <-chan struct{}
+				done, err = WithDeadline(*writeDeadline, func() error {
+					return AppendWithRetry(path, encoded, !*noSync, *writeRetries, *writeRetryBackoff)
+				})
+				statsd.Timing("write.latency", time.Since(writeStarted))
+				if err == nil || errors.Is(err, ErrWriteDeadline) {
+					session.fileBytes += uint64(len(encoded))
+				}
+				if errors.Is(err, ErrWriteDeadline) {
+					// The line may still land, so its sequence number is used up
+					session.Seq++
+					session.abandoned = done
+				}
+			}
+			if err != nil {
+				session.writeErrors = RecordWriteError(session.writeErrors, WriteError{time.Now().Format(time.RFC3339Nano), err.Error()}, *errorHistory)
+				WritesFailed.Add(1)
+				statsd.Count("write.failed", 1)
+				return session, err
+			}
+			session.Seq++
+			session.Lines += uint64(strings.Count(logStatement, "\n"))
+			session.Bytes += uint64(len(logStatement))
+			Writes.Add(1)
+			BytesWritten.Add(int64(len(logStatement)))
+			statsd.Count("write.succeeded", 1)
+			statsd.Count("write.bytes", int64(len(logStatement)))
+			session.LastActivity = time.Now()
+			session.unsynced = *noSync && !session.Ephemeral
+			if session.recent != nil {
+				for _, line := range strings.Split(strings.TrimSuffix(logStatement, "\n"), "\n") {
+					session.recent.Add(line)
+				}
+			}
+			if syslogForwarder != nil {
+				syslogForwarder.Forward(session.Name, logStatement)
+			}
+
+			return session, nil
+		}
+
+		for {
+			select {
+			case createSession := <-createSessionReq:
+				// Only unnamed with -auto-name
+				autoNaming := createSession.Name == nil
+				if autoNaming {
+					name := fmt.Sprintf("session-%04d", autoNamed+1)
+					createSession.Name = &name
+				}
+				if createSession.ParentId != nil {
+					if _, exists := sessions[*createSession.ParentId]; !exists {
+						message := fmt.Sprintf("Parent session id %s does not exist", createSession.ParentId.String())
+						SendWithTimeout(createSessionRes, CreateSessionResult{Message: message, Status: http.StatusBadRequest}, *managerTimeout)
+						continue
+					}
+				}
+				id, _ := uuid.NewRandom()
+				created := time.Now()
+				nameTemplate := *createSession.Name
+				seq := nameSequences[nameTemplate] + 1
+				name := ExpandName(nameTemplate, seq, created, id)
+				createSession.Name = &name
+				if !IsSafeName(name) {
+					SendWithTimeout(createSessionRes, CreateSessionResult{Message: fmt.Sprintf("%q can't be used as a session name", name), Status: http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				createIfNotExists := createSession.CreateIfNotExists != nil && *createSession.CreateIfNotExists
+				if createIfNotExists {
+					var existing *Session
+					for _, existingId := range namedSessions[name] {
+						if session := sessions[existingId]; session.Owner == createSession.Owner {
+							existing = &session
+							break
+						}
+					}
+					if existing != nil {
+						// The lease token is only ever given to the creator
+						SendWithTimeout(createSessionRes, CreateSessionResult{Session: existing.Copy(), Existing: true, Status: http.StatusOK}, *managerTimeout)
+						continue
+					}
+				}
+				if *maxPerName > 0 && nameCounts[*createSession.Name] >= *maxPerName {
+					message := fmt.Sprintf("There are already %d open session(s) named %q, please choose a unique name", nameCounts[*createSession.Name], *createSession.Name)
+					SendWithTimeout(createSessionRes, CreateSessionResult{Message: message, Status: http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				creationTime := created.Format(time.RFC3339)
+				dir := logDirs[placed%len(logDirs)]
+				if createSession.Dir != nil {
+					dir = *createSession.Dir
+				} else {
+					placed++
+				}
+				ephemeral := createSession.Ephemeral != nil && *createSession.Ephemeral
+				if *dateLayout != "" && !ephemeral {
+					dir = filepath.Join(dir, created.Format(*dateLayout))
+					if err := os.MkdirAll(dir, 0755); err != nil {
+						SendWithTimeout(createSessionRes, CreateSessionResult{Message: err.Error(), Status: http.StatusInternalServerError}, *managerTimeout)
+						continue
+					}
+				}
+				format := FormatText
+				if createSession.Format != nil {
+					format = *createSession.Format
+				}
+				session := Session{
+					Id:           id,
+					Name:         *createSession.Name,
+					CreationTime: creationTime,
+					Filepath:     filepath.Join(dir, fmt.Sprintf("%s-%s-%s", *createSession.Name, creationTime, id.String()[:8])),
+					Tags:         createSession.Tags,
+					Format:       format,
+					Owner:        createSession.Owner,
+					ParentId:     createSession.ParentId,
+				}
+				if createSession.MinLevel != nil {
+					session.MinLevel = *createSession.MinLevel
+				}
+				session.Charset = CharsetUTF8
+				if createSession.Charset != nil {
+					session.Charset = *createSession.Charset
+				}
+				if *memoryTail > 0 {
+					session.recent = NewLineRing(*memoryTail)
+				}
+				if createSession.Dedupe != nil {
+					session.Dedupe = *createSession.Dedupe
+				}
+				if createSession.ForwardTo != nil {
+					session.ForwardTo = *createSession.ForwardTo
+					session.ForwardId = createSession.ForwardId
+				}
+				if ephemeral {
+					session.Filepath = ""
+					session.Ephemeral = true
+				} else if *shardSize > 0 {
+					if err := os.MkdirAll(session.Filepath, 0755); err != nil {
+						SendWithTimeout(createSessionRes, CreateSessionResult{Message: HidePaths(err.Error(), *hideFilepaths, session.Filepath), Status: http.StatusInternalServerError}, *managerTimeout)
+						continue
+					}
+					session.Filepath = ShardPath(session.Filepath, 0)
+					session.Sharded = true
+				}
+				if *lease > 0 {
+					expiry := created.Add(*lease)
+					session.leaseToken = uuid.NewString()
+					session.LeaseExpiry = &expiry
+				}
+				if createSession.FailIfExists != nil && *createSession.FailIfExists {
+					err := CreateNewFile(session.Filepath)
+					if errors.Is(err, fs.ErrExist) {
+						SendWithTimeout(createSessionRes, CreateSessionResult{Message: HidePaths(fmt.Sprintf("%s already exists", session.Filepath), *hideFilepaths, session.Filepath), Status: http.StatusConflict}, *managerTimeout)
+						continue
+					}
+					if err != nil {
+						SendWithTimeout(createSessionRes, CreateSessionResult{Message: HidePaths(err.Error(), *hideFilepaths, session.Filepath), Status: http.StatusInternalServerError}, *managerTimeout)
+						continue
+					}
+				}
+				sessions[id] = session
+				nameCounts[session.Name]++
+				namedSessions[session.Name] = append(namedSessions[session.Name], id)
+				SessionsOpen.Add(1)
+				SessionsCreated.Add(1)
+				statsd.Count("session.created", 1)
+				if strings.Contains(nameTemplate, "{seq}") {
+					nameSequences[nameTemplate] = seq
+				}
+				if autoNaming {
+					autoNamed++
+				}
+				notify(EventCreated, session)
+				status := uint(http.StatusOK)
+				if createIfNotExists {
+					status = http.StatusCreated
+				}
+				SendWithTimeout(createSessionRes, CreateSessionResult{Session: session.Copy(), LeaseToken: session.leaseToken, Status: status}, *managerTimeout)
+			case <-listSessionReq:
+				var results []Session
+				for k := range sessions {
+					results = append(results, sessions[k].Copy())
+				}
+				SendWithTimeout(listSessionRes, results, *managerTimeout)
+			case closeSession := <-closeSessionReq:
+				id := *closeSession.Id
+				session, exists := sessions[id]
+				if exists {
+					endSession(session)
+					SendWithTimeout(closeSessionRes, CloseSessionResponse{fmt.Sprintf("Successfully closed session with id %s\n", id.String()), http.StatusOK}, *managerTimeout)
+				} else if closeSession.Idempotent {
+					SendWithTimeout(closeSessionRes, CloseSessionResponse{fmt.Sprintf("Session id %s is already closed or does not exist (idempotent)\n", id.String()), http.StatusOK}, *managerTimeout)
+				} else {
+					SendWithTimeout(closeSessionRes, CloseSessionResponse{fmt.Sprintf("Session id %s does not exist\n", id.String()), http.StatusBadRequest}, *managerTimeout)
+				}
+			case moveSession := <-moveSessionReq:
+				id := *moveSession.Id
+				session, exists := sessions[id]
+				if !exists {
+					SendWithTimeout(moveSessionRes, MoveSessionResponse{fmt.Sprintf("Session id %s does not exist\n", id.String()), http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				if session.Ephemeral {
+					SendWithTimeout(moveSessionRes, MoveSessionResponse{"Ephemeral sessions have no file to move\n", http.StatusConflict}, *managerTimeout)
+					continue
+				}
+				if session.Sharded {
+					SendWithTimeout(moveSessionRes, MoveSessionResponse{"Sharded sessions can't be moved\n", http.StatusConflict}, *managerTimeout)
+					continue
+				}
+				target := filepath.Join(*moveSession.Dir, filepath.Base(session.Filepath))
+				if _, err := os.Stat(target); err == nil {
+					SendWithTimeout(moveSessionRes, MoveSessionResponse{HidePaths(fmt.Sprintf("%s already exists\n", target), *hideFilepaths, target), http.StatusConflict}, *managerTimeout)
+					continue
+				}
+				if err := MoveFile(session.Filepath, target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					SendWithTimeout(moveSessionRes, MoveSessionResponse{HidePaths(fmt.Sprintf("%s\n", err.Error()), *hideFilepaths, target, session.Filepath), http.StatusInternalServerError}, *managerTimeout)
+					continue
+				}
+				session.Filepath = target
+				sessions[id] = session
+				SendWithTimeout(moveSessionRes, MoveSessionResponse{HidePaths(fmt.Sprintf("Moved session with id %s to %s\n", id.String(), target), *hideFilepaths, target), http.StatusOK}, *managerTimeout)
+			case now := <-idleFlushTick:
+				for id, session := range sessions {
+					if session.unsynced && now.Sub(session.LastActivity) >= *idleFlush {
+						if err := SyncFile(session.Filepath); err != nil {
+							log.Printf("Could not sync %s: %s", session.Filepath, err.Error())
+						}
+						session.unsynced = false
+						sessions[id] = session
+					}
+				}
+			case boundary := <-rolloverTick:
+				suffix := rollover.Suffix(boundary)
+				for id, session := range sessions {
+					// Sharded sessions are already split into files of their own
+					if session.Ephemeral || session.Sharded {
+						continue
+					}
+					if info, err := os.Stat(session.Filepath); err != nil || info.Size() == 0 {
+						continue
+					}
+					if _, err := rollFile(id, suffix); err != nil {
+						log.Printf("Could not roll over %s: %s", session.Filepath, err.Error())
+					}
+				}
+			case pauseSession := <-pauseSessionReq:
+				id := *pauseSession.Id
+				session, exists := sessions[id]
+				if !exists {
+					SendWithTimeout(pauseSessionRes, PauseSessionResponse{fmt.Sprintf("Session id %s does not exist\n", id.String()), http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				session.Paused = pauseSession.Paused
+				sessions[id] = session
+				state := "Resumed"
+				if session.Paused {
+					state = "Paused"
+				}
+				SendWithTimeout(pauseSessionRes, PauseSessionResponse{fmt.Sprintf("%s session with id %s\n", state, id.String()), http.StatusOK}, *managerTimeout)
+			case updateTags := <-updateTagsReq:
+				id := *updateTags.Id
+				session, exists := sessions[id]
+				if !exists {
+					SendWithTimeout(updateTagsRes, UpdateTagsResponse{Message: fmt.Sprintf("Session id %s does not exist\n", id.String()), Status: http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				// A new map, copies of the session handed out earlier may share the old one
+				tags := make(map[string]string)
+				if updateTags.Mode == TagsMerge {
+					for key, value := range session.Tags {
+						tags[key] = value
+					}
+				}
+				for key, value := range updateTags.Tags {
+					if value == nil {
+						delete(tags, key)
+					} else {
+						tags[key] = *value
+					}
+				}
+				session.Tags = tags
+				sessions[id] = session
+				SendWithTimeout(updateTagsRes, UpdateTagsResponse{Status: http.StatusOK, Tags: session.Copy().Tags}, *managerTimeout)
+			case rotateSession := <-rotateSessionReq:
+				id := *rotateSession.Id
+				session, exists := sessions[id]
+				if !exists {
+					SendWithTimeout(rotateSessionRes, RotateSessionResponse{Message: fmt.Sprintf("Session id %s does not exist\n", id.String()), Status: http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				if session.Ephemeral {
+					SendWithTimeout(rotateSessionRes, RotateSessionResponse{Message: "Ephemeral sessions have no file to rotate\n", Status: http.StatusConflict}, *managerTimeout)
+					continue
+				}
+				if session.Sharded {
+					SendWithTimeout(rotateSessionRes, RotateSessionResponse{Message: "Sharded sessions start new files on their own and can't be rotated\n", Status: http.StatusConflict}, *managerTimeout)
+					continue
+				}
+				target, err := rollFile(id, time.Now().Format("2006-01-02T15:04:05.000000000"))
+				if errors.Is(err, fs.ErrNotExist) {
+					SendWithTimeout(rotateSessionRes, RotateSessionResponse{Message: "Nothing has been written to the session yet\n", Status: http.StatusConflict}, *managerTimeout)
+					continue
+				}
+				if err != nil {
+					SendWithTimeout(rotateSessionRes, RotateSessionResponse{Message: HidePaths(fmt.Sprintf("%s\n", err.Error()), *hideFilepaths, session.Filepath), Status: http.StatusInternalServerError}, *managerTimeout)
+					continue
+				}
+				SendWithTimeout(rotateSessionRes, RotateSessionResponse{Status: http.StatusOK, RotatedPath: target}, *managerTimeout)
+			case env := <-reloadReq:
+				flag.VisitAll(func(f *flag.Flag) {
+					name := EnvName(f.Name)
+					value, set := env[name]
+					if previous, wasSet := appliedEnv[name]; explicitFlags[f.Name] || !set || (wasSet && previous == value) {
+						return
+					}
+					if !ReloadableFlags[f.Name] {
+						log.Printf("Ignoring change to %s, -%s can't be changed without a restart", name, f.Name)
+						return
+					}
+					current := f.Value.String()
+					if err := flag.Set(f.Name, value); err != nil {
+						// Numeric flags are overwritten even when parsing fails
+						f.Value.Set(current)
+						log.Printf("Ignoring invalid %s: %s", name, err.Error())
+						return
+					}
+					fmt.Printf("Reloaded -%s=%s\n", f.Name, f.Value.String())
+				})
+				appliedEnv = env
+			case <-configReq:
+				SendWithTimeout(configRes, EffectiveConfig(), *managerTimeout)
+			case renewSession := <-renewSessionReq:
+				id := *renewSession.Id
+				session, exists := sessions[id]
+				if !exists {
+					SendWithTimeout(renewSessionRes, RenewSessionResult{Message: fmt.Sprintf("Session id %s does not exist\n", id.String()), Status: http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+				if session.leaseToken == "" || *renewSession.LeaseToken != session.leaseToken {
+					SendWithTimeout(renewSessionRes, RenewSessionResult{Message: "A valid lease token is required to renew this session\n", Status: http.StatusForbidden}, *managerTimeout)
+					continue
+				}
+				expiry := time.Now().Add(*lease)
+				session.LeaseExpiry = &expiry
+				sessions[id] = session
+				SendWithTimeout(renewSessionRes, RenewSessionResult{Status: http.StatusOK, LeaseExpiry: expiry}, *managerTimeout)
+			case id := <-recentSessionReq:
+				recent := RecentSession{Id: id, Lines: []string{}}
+				if session, exists := sessions[id]; exists {
+					recent.Exists = true
+					if session.recent != nil {
+						recent.Lines = session.recent.Lines()
+					}
+				}
+				SendWithTimeout(recentSessionRes, recent, *managerTimeout)
+			case id := <-sessionTreeReq:
+				// Closed sessions can still be read, so they stay in the tree
+				var all []Session
+				var tree []Session
+				for _, known := range []map[uuid.UUID]Session{sessions, closedSessions} {
+					for _, session := range known {
+						all = append(all, session.Copy())
+					}
+				}
+				for _, session := range all {
+					if session.Id == id {
+						tree = SessionTree(all, session)
+					}
+				}
+				SendWithTimeout(sessionTreeRes, tree, *managerTimeout)
+			case <-debugReq:
+				state := DebugState{Sessions: []DebugSession{}, ClosedSessions: []Session{}, NameCounts: make(map[string]int), AutoNamed: autoNamed}
+				for _, session := range sessions {
+					session = session.Copy()
+					state.Sessions = append(state.Sessions, DebugSession{session, session.writeErrors, session.unsynced})
+				}
+				for _, session := range closedSessions {
+					state.ClosedSessions = append(state.ClosedSessions, session.Copy())
+				}
+				for name, count := range nameCounts {
+					state.NameCounts[name] = count
+				}
+				SendWithTimeout(debugRes, state, *managerTimeout)
+			case closeByTag := <-closeByTagReq:
+				key, value, _ := ParseTag(*closeByTag.Tag)
+				closed := []uuid.UUID{}
+				for id, session := range sessions {
+					if tagValue, ok := session.Tags[key]; ok && tagValue == value {
+						closed = append(append(closed, endSession(session)...), id)
+					}
+				}
+				SendWithTimeout(closeByTagRes, CloseByTagResponse{len(closed), closed}, *managerTimeout)
+			case id := <-sessionErrorsReq:
+				session, exists := sessions[id]
+				errs := make([]WriteError, len(session.writeErrors))
+				for i, writeError := range session.writeErrors {
+					errs[i] = WriteError{writeError.Time, HidePaths(writeError.Message, *hideFilepaths, session.Filepath)}
+				}
+				SendWithTimeout(sessionErrorsRes, SessionErrorsResult{exists, errs}, *managerTimeout)
+			case id := <-getSessionReq:
+				if session, exists := sessions[id]; exists {
+					SendWithTimeout(getSessionRes, SessionLookup{Exists: true, Session: session.Copy()}, *managerTimeout)
+				} else {
+					session, closed := closedSessions[id]
+					SendWithTimeout(getSessionRes, SessionLookup{Closed: closed, Session: session.Copy()}, *managerTimeout)
+				}
+			case writeSession := <-writeSessionReq:
+				id := *writeSession.Id
+				session, exists := sessions[id]
+				if closedAt, closed := recentlyClosed[id]; !exists && closed && time.Since(closedAt) <= *goneWindow {
+					SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: fmt.Sprintf("Session id %s was closed at %s\n", id.String(), closedAt.Format(time.RFC3339Nano)), Status: http.StatusGone}, *managerTimeout)
+					continue
+				}
+				if !exists {
+					SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: fmt.Sprintf("Session id %s does not exist\n", id.String()), Status: http.StatusBadRequest}, *managerTimeout)
+					continue
+				}
+
+				if session.leaseToken != "" {
+					if writeSession.LeaseToken == nil || *writeSession.LeaseToken != session.leaseToken {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: "A valid lease token is required to write to this session\n", Status: http.StatusForbidden}, *managerTimeout)
+						continue
+					}
+					if time.Now().After(*session.LeaseExpiry) {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: fmt.Sprintf("Lease expired at %s, renew it with /renew-session\n", session.LeaseExpiry.Format(time.RFC3339Nano)), Status: http.StatusConflict}, *managerTimeout)
+						continue
+					}
+				}
+				if session.Paused {
+					if *dropPausedWrites {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Status: http.StatusOK, Skipped: true}, *managerTimeout)
+					} else {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: fmt.Sprintf("Session id %s is paused\n", id.String()), Status: http.StatusLocked}, *managerTimeout)
+					}
+					continue
+				}
+				if writeSession.Level != nil && session.MinLevel != "" {
+					rank, _ := LevelRank(*writeSession.Level)
+					if minRank, _ := LevelRank(session.MinLevel); rank < minRank {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Status: http.StatusOK, Skipped: true}, *managerTimeout)
+						continue
+					}
+				}
+
+				var hash uint64
+				if session.Dedupe {
+					hash = WriteHash(writeSession)
+					if hash == session.lastHash && time.Since(session.lastHashAt) <= *dedupeWindow {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: "Skipped duplicate of the previous write\n", Status: http.StatusOK, Skipped: true}, *managerTimeout)
+						continue
+					}
+				}
+
+				timestamp := time.Now()
+				if writeSession.Timestamp != nil {
+					timestamp = *writeSession.Timestamp
+				}
+				now := timestamp.Format(time.RFC3339Nano)
+				content, fields := *writeSession.Content, writeSession.Fields
+				if writeSession.Level != nil {
+					// Copied, the fields are the request's own map
+					withLevel := make(map[string]interface{}, len(fields)+1)
+					for k, v := range fields {
+						withLevel[k] = v
+					}
+					withLevel["level"] = strings.ToLower(*writeSession.Level)
+					fields = withLevel
+				}
+				session, err := appendLine(session, now, content, fields)
+				sessions[id] = session
+				if err != nil {
+					if errors.Is(err, syscall.ENOSPC) {
+						if *retention > 0 {
+							// The sweep asks the manager for open sessions, so it has to run elsewhere
+							select {
+							case sweepNow <- true:
+							default:
+							}
+						}
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: HidePaths(fmt.Sprintf("Disk full, could not write to %s\n", session.Filepath), *hideFilepaths, session.Filepath), Status: http.StatusInsufficientStorage}, *managerTimeout)
+						continue
+					}
+					if errors.Is(err, ErrWriteDeadline) {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: HidePaths(fmt.Sprintf("Writing to %s took longer than %s\n", session.Filepath, *writeDeadline), *hideFilepaths, session.Filepath), Status: http.StatusGatewayTimeout}, *managerTimeout)
+						continue
+					}
+					if errors.Is(err, ErrWriteInProgress) {
+						SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: HidePaths(fmt.Sprintf("An earlier write to %s hasn't finished, try again later\n", session.Filepath), *hideFilepaths, session.Filepath), Status: http.StatusServiceUnavailable}, *managerTimeout)
+						continue
+					}
+					SendWithTimeout(writeSessionRes, WriteSessionResponse{Message: HidePaths(fmt.Sprintf("%s\n", err.Error()), *hideFilepaths, session.Filepath), Status: http.StatusInternalServerError}, *managerTimeout)
+					continue
+				}
+				if session.Dedupe {
+					session.lastHash, session.lastHashAt = hash, time.Now()
+					sessions[id] = session
+				}
+				if session.ForwardTo != "" {
+					forwarder.Forward(ForwardedWrite{session.ForwardTo, *session.ForwardId, WriteSessionRequest{Content: &content, Fields: fields, Timestamp: &timestamp, Level: writeSession.Level}})
+				}
+
+				SendWithTimeout(writeSessionRes, WriteSessionResponse{Status: http.StatusOK, Timestamp: now}, *managerTimeout)
+			}
+		}
+
+	}()
+
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		for range hangups {
+			env, err := ReadEnv(*envFile)
+			if err != nil {
+				log.Printf("Could not reload configuration: %s", err.Error())
+				continue
+			}
+			reloadReq <- env
+		}
+	}()
+
+	sweep := func() {
+		sessions, ok := CallManager(listSessionReq, listSessionRes, true, *managerTimeout)
+		if !ok {
+			log.Print("Skipping retention sweep, " + ManagerUnavailable)
+			return
+		}
+		open := make(map[string]bool)
+		for _, session := range sessions {
+			open[session.Filepath] = true
+			if session.Sharded {
+				open[filepath.Dir(session.Filepath)] = true
+			}
+		}
+		for _, dir := range logDirs {
+			for _, path := range SweepOldFiles(dir, time.Now().Add(-*retention), open) {
+				fmt.Printf("Deleted %s, older than retention of %s\n", path, *retention)
+			}
+		}
+	}
+	if *retention > 0 {
+		go func() {
+			ticks := time.Tick(*sweepInterval)
+			for {
+				select {
+				case <-ticks:
+				case <-sweepNow:
+					fmt.Println("Disk full, sweeping files older than retention early")
+				}
+				sweep()
+			}
+		}()
+	}
+
+	var integrity *IntegrityChecker
+	if *integrityInterval > 0 {
+		integrity = NewIntegrityChecker()
+		go func() {
+			for range time.Tick(*integrityInterval) {
+				sessions, ok := CallManager(listSessionReq, listSessionRes, true, *managerTimeout)
+				if !ok {
+					log.Print("Skipping integrity check, " + ManagerUnavailable)
+					continue
+				}
+				for _, problem := range integrity.Check(sessions) {
+					if problem.Problem == IntegrityMissing {
+						log.Printf("Session %s file %s is missing, %d bytes were written to it", problem.Id.String(), problem.Filepath, problem.Written)
+					} else {
+						log.Printf("Session %s file %s is truncated to %d bytes, %d were written to it", problem.Id.String(), problem.Filepath, problem.Size, problem.Written)
+					}
+				}
+			}
+		}()
+	}
+
+	// Finds the open or closed session named by the 'id' query parameter, writing the error response if there isn't one.
+	lookupSession := func(w http.ResponseWriter, r *http.Request) (SessionLookup, bool) {
+		id, err := uuid.Parse(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid session id", http.StatusBadRequest)
+			return SessionLookup{}, false
+		}
+		result, ok := CallManager(getSessionReq, getSessionRes, id, *managerTimeout)
+		if !ok {
+			http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+			return result, false
+		}
+		if !result.Exists && !result.Closed {
+			http.Error(w, fmt.Sprintf("Session id %s does not exist", id.String()), http.StatusNotFound)
+			return result, false
+		}
+
+		return result, true
+	}
+
+	// Like lookupSession, but rejects ephemeral sessions, which have no file to read.
+	lookupFileSession := func(w http.ResponseWriter, r *http.Request) (SessionLookup, bool) {
+		result, ok := lookupSession(w, r)
+		if ok && result.Session.Ephemeral {
+			http.Error(w, "Ephemeral sessions are only written to stdout and can't be read", http.StatusConflict)
+			return result, false
+		}
+
+		return result, ok
+	}
+
+	inFlight := NewInFlightWrites()
+	streams := NewStreamWrites()
+
+	var createLimiter *TokenBucket
+	if *createRate > 0 {
+		createLimiter = NewTokenBucket(*createRate)
+	}
+
+	// Validates a write and hands it to the manager. Shared by every endpoint that appends lines.
+	submitWrite := func(writeSession WriteSessionRequest, leaseToken string) WriteSessionResponse {
+		if writeSession.Id == nil || writeSession.Content == nil {
+			return WriteSessionResponse{Message: "Invalid write session object\n", Status: http.StatusBadRequest}
+		}
+		if writeSession.Level != nil {
+			if _, ok := LevelRank(*writeSession.Level); !ok {
+				return WriteSessionResponse{Message: fmt.Sprintf("level must be one of %s\n", strings.Join(LogLevels, ", ")), Status: http.StatusBadRequest}
+			}
+		}
+		// A write with fields still says something without content
+		if *writeSession.Content == "" && len(writeSession.Fields) == 0 {
+			if !*allowEmptyWrites {
+				return WriteSessionResponse{Message: "Content is empty\n", Status: http.StatusBadRequest}
+			}
+			return WriteSessionResponse{Message: "Skipped empty write\n", Status: http.StatusOK, Skipped: true}
+		}
+		if writeSession.LeaseToken == nil && leaseToken != "" {
+			writeSession.LeaseToken = &leaseToken
+		}
+		inFlight.Begin(*writeSession.Id)
+		defer inFlight.End(*writeSession.Id)
+		// Redacted before the length check, so truncation can't cut a secret short of matching its pattern
+		redacted := Redact(*writeSession.Content, redactPatterns)
+		writeSession.Content = &redacted
+		writeSession.Fields = RedactFields(writeSession.Fields, redactPatterns)
+		if *maxLineLength > 0 && len(*writeSession.Content) > *maxLineLength {
+			if *onOversize == OversizeReject {
+				return WriteSessionResponse{Message: fmt.Sprintf("Content exceeds maximum line length of %d bytes\n", *maxLineLength), Status: http.StatusBadRequest}
+			}
+			truncated := TruncateContent(*writeSession.Content, *maxLineLength)
+			writeSession.Content = &truncated
+		}
+		result, ok := CallManager(writeSessionReq, writeSessionRes, writeSession, *managerTimeout)
+		if !ok {
+			return WriteSessionResponse{Message: ManagerUnavailable + "\n", Status: http.StatusServiceUnavailable}
+		}
+
+		return result
+	}
+
+	http.HandleFunc("/create-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			if createLimiter != nil && !createLimiter.Allow() {
+				http.Error(w, "Too many sessions are being created, try again later", http.StatusTooManyRequests)
+				return
+			}
+			var newSession CreateSessionRequest
+			err := DecodeRequest(r.Body, &newSession, *strictJSON)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if newSession.Name == nil && *defaultName != "" {
+				newSession.Name = defaultName
+			}
+			if newSession.Name == nil && !*autoName {
+				http.Error(w, "Invalid create session object", http.StatusBadRequest)
+				return
+			}
+			newSession.Owner = ClientIdentity(r)
+			if newSession.Dir != nil {
+				dir, err := ResolveDir(*newSession.Dir)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if !IsWithinDirs(dir, allowedDirs) {
+					http.Error(w, fmt.Sprintf("%s is not an allowed directory", *newSession.Dir), http.StatusForbidden)
+					return
+				}
+				newSession.Dir = &dir
+			}
+			if *stdoutMode {
+				ephemeral := true
+				newSession.Ephemeral = &ephemeral
+			}
+			if newSession.Ephemeral != nil && *newSession.Ephemeral && (newSession.Dir != nil || newSession.FailIfExists != nil) {
+				http.Error(w, "Ephemeral sessions have no file, so dir and fail_if_exists can't be set", http.StatusBadRequest)
+				return
+			}
+			if newSession.MinLevel != nil {
+				if _, ok := LevelRank(*newSession.MinLevel); !ok {
+					http.Error(w, fmt.Sprintf("min_level must be one of %s", strings.Join(LogLevels, ", ")), http.StatusBadRequest)
+					return
+				}
+			}
+			if (newSession.ForwardTo == nil) != (newSession.ForwardId == nil) {
+				http.Error(w, "forward_to and forward_id must be set together", http.StatusBadRequest)
+				return
+			}
+			if newSession.ForwardTo != nil {
+				if parsed, err := url.Parse(*newSession.ForwardTo); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+					http.Error(w, "forward_to must be an http or https URL", http.StatusBadRequest)
+					return
+				}
+			}
+			if newSession.Charset != nil && !IsCharset(*newSession.Charset) {
+				http.Error(w, fmt.Sprintf("charset must be one of %s", strings.Join(Charsets, ", ")), http.StatusBadRequest)
+				return
+			}
+			if newSession.Format != nil && *newSession.Format != FormatText && *newSession.Format != FormatJSON {
+				http.Error(w, fmt.Sprintf("Format must be %q or %q", FormatText, FormatJSON), http.StatusBadRequest)
+				return
+			}
+			result, ok := CallManager(createSessionReq, createSessionRes, newSession, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			if result.Status != http.StatusOK && result.Status != http.StatusCreated {
+				http.Error(w, result.Message, int(result.Status))
+				return
+			}
+			session := result.Session
+			AuditSession(r, session.Id)
+			if *hideFilepaths {
+				session.Filepath = Redacted
+			}
+
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+				// Just the id, for shell scripts. The lease token, if any, is sent as a header
+				w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+				if result.LeaseToken != "" {
+					w.Header().Add(LeaseTokenHeader, result.LeaseToken)
+				}
+				w.WriteHeader(int(result.Status))
+				fmt.Fprintln(w, session.Id.String())
+			} else if *terseResponses {
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(int(result.Status))
+				ResponseEncoder(w, *pretty).Encode(CreateSessionResponse{session.Id, result.LeaseToken})
+			} else {
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(int(result.Status))
+				ResponseEncoder(w, *pretty).Encode(CreatedSession{session, result.LeaseToken})
+			}
+			if result.Existing {
+				fmt.Printf("Found existing session with id=%s request_id=%s\n", session.Id, RequestId(r))
+			} else {
+				fmt.Printf("Session created with id=%s request_id=%s\n", session.Id, RequestId(r))
+			}
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/list-sessions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			var activeWithin time.Duration
+			if value := r.URL.Query().Get("active_within"); value != "" {
+				var err error
+				if activeWithin, err = time.ParseDuration(value); err != nil || activeWithin <= 0 {
+					http.Error(w, "active_within must be a positive duration", http.StatusBadRequest)
+					return
+				}
+			}
+			var limit int
+			if value := r.URL.Query().Get("limit"); value != "" {
+				var err error
+				if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+					http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+					return
+				}
+			}
+			cursor := r.URL.Query().Get("cursor")
+
+			w.Header().Add("Content-Type", "application/json")
+			sessions, ok := CallManager(listSessionReq, listSessionRes, true, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			var parent uuid.UUID
+			_, filterByParent := r.URL.Query()["parent"]
+			if filterByParent {
+				var err error
+				if parent, err = uuid.Parse(r.URL.Query().Get("parent")); err != nil {
+					http.Error(w, "Invalid parent session id", http.StatusBadRequest)
+					return
+				}
+			}
+			owner, filterByOwner := r.URL.Query()["owner"]
+			if activeWithin > 0 || filterByOwner || filterByParent {
+				cutoff := time.Now().Add(-activeWithin)
+				filtered := []Session{}
+				for _, session := range sessions {
+					if activeWithin > 0 && !session.LastActivity.After(cutoff) {
+						continue
+					}
+					if filterByOwner && session.Owner != owner[0] {
+						continue
+					}
+					if filterByParent && (session.ParentId == nil || *session.ParentId != parent) {
+						continue
+					}
+					filtered = append(filtered, session)
+				}
+				sessions = filtered
+			}
+			var next string
+			if limit > 0 || cursor != "" {
+				var err error
+				if sessions, next, err = PageSessions(sessions, cursor, limit); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if next != "" {
+					w.Header().Set("X-Next-Cursor", next)
+				}
+			}
+			var previews map[uuid.UUID]string
+			if preview, _ := strconv.ParseBool(r.URL.Query().Get("preview")); preview {
+				previews = make(map[uuid.UUID]string)
+				for _, session := range sessions {
+					// utf16le files can't be split on '\n' bytes
+					if session.Ephemeral || session.Charset != CharsetUTF8 {
+						continue
+					}
+					if line, err := ReadLastLine(session.Filepath); err == nil {
+						previews[session.Id] = line
+					}
+				}
+			}
+			if *hideFilepaths {
+				for i := range sessions {
+					sessions[i].Filepath = Redacted
+				}
+			}
+			if r.URL.Query().Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				WriteSessionsCSV(w, sessions)
+				return
+			}
+			ResponseEncoder(w, *pretty).Encode(ListSession{sessions, next, previews})
+			w.Header().Add("Status", fmt.Sprint(http.StatusOK))
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/close-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var closeSession CloseSessionRequest
+			if err := DecodeRequest(r.Body, &closeSession, *strictJSON); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if closeSession.Id == nil {
+				http.Error(w, "Invalid close session object", http.StatusBadRequest)
+				return
+			}
+			if r.URL.Query().Get("idempotent") == "true" {
+				closeSession.Idempotent = true
+			}
+			if closeSession.FinalContent != nil {
+				lookup, ok := CallManager(getSessionReq, getSessionRes, *closeSession.Id, *managerTimeout)
+				if !ok {
+					http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+					return
+				}
+				// Written like any other write, so it needs the lease and is held to the same limits. Closing an id that
+				// isn't open is answered by the close below.
+				if lookup.Exists {
+					result := submitWrite(WriteSessionRequest{Id: closeSession.Id, Content: closeSession.FinalContent, LeaseToken: closeSession.LeaseToken}, r.Header.Get(LeaseTokenHeader))
+					if result.Status != http.StatusOK {
+						w.Header().Add("Status", fmt.Sprint(result.Status))
+						w.WriteHeader(int(result.Status))
+						fmt.Fprintf(w, "Could not write final content, session left open: %s", result.Message)
+						return
+					}
+				}
+			}
+			if *closeFlushTimeout > 0 && !inFlight.Wait(*closeSession.Id, *closeFlushTimeout) {
+				fmt.Printf("Closing session %s with writes still in flight after %s request_id=%s\n", closeSession.Id.String(), *closeFlushTimeout, RequestId(r))
+			}
+			AuditSession(r, *closeSession.Id)
+			result, ok := CallManager(closeSessionReq, closeSessionRes, closeSession, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			w.WriteHeader(int(result.Status))
+			fmt.Fprint(w, result.Message)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/write-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var writeSession WriteSessionRequest
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/plain" {
+				// The body is the content, verbatim apart from one trailing newline
+				id, err := uuid.Parse(r.URL.Query().Get("id"))
+				if err != nil {
+					http.Error(w, "Invalid session id", http.StatusBadRequest)
+					return
+				}
+				body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxStreamLineBytes))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				content := strings.TrimSuffix(string(body), "\n")
+				writeSession = WriteSessionRequest{Id: &id, Content: &content}
+			} else if err := DecodeRequest(r.Body, &writeSession, *strictJSON); err != nil {
+				// Also covers a Timestamp that isn't RFC3339
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if writeSession.Id != nil {
+				AuditSession(r, *writeSession.Id)
+			}
+			result := submitWrite(writeSession, r.Header.Get(LeaseTokenHeader))
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			if result.Status != http.StatusOK {
+				w.WriteHeader(int(result.Status))
+				fmt.Fprint(w, result.Message)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(result)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/renew-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var renewSession RenewSessionRequest
+			if err := DecodeRequest(r.Body, &renewSession, *strictJSON); err != nil || renewSession.Id == nil {
+				http.Error(w, "Invalid renew session object", http.StatusBadRequest)
+				return
+			}
+			if renewSession.LeaseToken == nil {
+				leaseToken := r.Header.Get(LeaseTokenHeader)
+				renewSession.LeaseToken = &leaseToken
+			}
+			AuditSession(r, *renewSession.Id)
+			result, ok := CallManager(renewSessionReq, renewSessionRes, renewSession, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			if result.Status != http.StatusOK {
+				w.WriteHeader(int(result.Status))
+				fmt.Fprint(w, result.Message)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(result)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/stream-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			id, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "Invalid session id", http.StatusBadRequest)
+				return
+			}
+
+			maxLine := MaxStreamLineBytes
+			if *maxLineLength > maxLine {
+				maxLine = *maxLineLength
+			}
+			// Count the whole stream as in flight so a close waits for it
+			inFlight.Begin(id)
+			defer inFlight.End(id)
+			cancelled := make(chan struct{})
+			var once sync.Once
+			stop := func() { once.Do(func() { close(cancelled) }) }
+			defer stop()
+			writeId := streams.Start(id, RequestId(r), stop)
+			defer streams.End(writeId)
+			w.Header().Set(WriteIdHeader, writeId.String())
+			scanner := bufio.NewScanner(r.Body)
+			scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+
+			// Read in the background, so a cancel isn't held up by a client that has stopped sending. Returning drops the
+			// connection, which ends the read.
+			lines := make(chan string)
+			go func() {
+				defer close(lines)
+				for scanner.Scan() {
+					select {
+					case lines <- scanner.Text():
+					case <-cancelled:
+						return
+					}
+				}
+			}()
+			written := 0
+			for done := false; !done; {
+				select {
+				case content, ok := <-lines:
+					if !ok {
+						done = true
+						break
+					}
+					result := submitWrite(WriteSessionRequest{Id: &id, Content: &content}, r.Header.Get(LeaseTokenHeader))
+					if result.Status != http.StatusOK {
+						http.Error(w, fmt.Sprintf("Wrote %d line(s) before failing: %s", written, result.Message), int(result.Status))
+						return
+					}
+					written++
+					streams.Wrote(writeId, written)
+				case <-cancelled:
+					// Otherwise the server waits for the rest of the body before responding, to reuse the connection
+					w.Header().Set("Connection", "close")
+					fmt.Printf("Stream %s to session %s cancelled after %d line(s) request_id=%s\n", writeId.String(), id.String(), written, RequestId(r))
+					http.Error(w, fmt.Sprintf("Wrote %d line(s) before the write was cancelled", written), http.StatusConflict)
+					return
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				// Usually the client went away mid-stream. Lines already written are kept.
+				fmt.Printf("Stream to session %s ended after %d line(s): %s request_id=%s\n", id.String(), written, err.Error(), RequestId(r))
+				http.Error(w, fmt.Sprintf("Wrote %d line(s) before failing: %s", written, err.Error()), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(StreamSessionResponse{written, writeId})
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/writes", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(streams.List())
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/cancel-write", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			id, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "Invalid write id", http.StatusBadRequest)
+				return
+			}
+			if !streams.Cancel(id) {
+				http.Error(w, fmt.Sprintf("No stream with write id %s is running", id.String()), http.StatusNotFound)
+				return
+			}
+			w.Header().Add("Status", fmt.Sprint(http.StatusOK))
+			fmt.Fprintf(w, "Cancelled write %s\n", id.String())
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/replay", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var replay ReplaySessionRequest
+			if err := DecodeRequest(r.Body, &replay, *strictJSON); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if replay.SourceId == nil || replay.TargetId == nil {
+				http.Error(w, "Invalid replay object", http.StatusBadRequest)
+				return
+			}
+			if replay.Speed != nil && *replay.Speed < 0 {
+				http.Error(w, "Speed must not be negative", http.StatusBadRequest)
+				return
+			}
+			source, ok := CallManager(getSessionReq, getSessionRes, *replay.SourceId, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			if !source.Exists && !source.Closed {
+				http.Error(w, fmt.Sprintf("Session id %s does not exist", replay.SourceId.String()), http.StatusNotFound)
+				return
+			}
+			if source.Session.Ephemeral {
+				http.Error(w, "Ephemeral sessions can't be replayed", http.StatusConflict)
+				return
+			}
+
+			file, err := OpenSessionText(source.Session)
+			if errors.Is(err, fs.ErrNotExist) {
+				w.Header().Add("Content-Type", "application/json")
+				ResponseEncoder(w, *pretty).Encode(ReplaySessionResponse{0})
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer file.Close()
+
+			AuditSession(r, *replay.TargetId)
+			inFlight.Begin(*replay.TargetId)
+			defer inFlight.End(*replay.TargetId)
+			replayed := 0
+			var previous time.Time
+			reader := bufio.NewReader(file)
+			for {
+				line, readErr := reader.ReadBytes('\n')
+				if len(bytes.TrimSpace(line)) > 0 {
+					var timestamp *time.Time
+					if lineTime, ok := LineTime(line, source.Session.Format); ok {
+						timestamp = &lineTime
+						if replay.Speed != nil && *replay.Speed > 0 && !previous.IsZero() && lineTime.After(previous) {
+							select {
+							case <-time.After(time.Duration(float64(lineTime.Sub(previous)) / *replay.Speed)):
+							case <-r.Context().Done():
+								return
+							}
+						}
+						previous = lineTime
+					}
+					content, fields := ReplayContent(line, source.Session.Format, *lineTemplateText == DefaultLineTemplate)
+					result := submitWrite(WriteSessionRequest{Id: replay.TargetId, Content: &content, Fields: fields, Timestamp: timestamp}, r.Header.Get(LeaseTokenHeader))
+					if result.Status != http.StatusOK {
+						http.Error(w, fmt.Sprintf("Replayed %d line(s) before failing: %s", replayed, result.Message), int(result.Status))
+						return
+					}
+					replayed++
+				}
+				if readErr == io.EOF {
+					break
+				}
+				if readErr != nil {
+					http.Error(w, fmt.Sprintf("Replayed %d line(s) before failing: %s", replayed, readErr.Error()), http.StatusInternalServerError)
+					return
+				}
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(ReplaySessionResponse{replayed})
+			fmt.Printf("Replayed %d line(s) from %s into %s request_id=%s\n", replayed, replay.SourceId.String(), replay.TargetId.String(), RequestId(r))
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/move-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var moveSession MoveSessionRequest
+			if err := DecodeRequest(r.Body, &moveSession, *strictJSON); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if moveSession.Id == nil || moveSession.Dir == nil {
+				http.Error(w, "Invalid move session object", http.StatusBadRequest)
+				return
+			}
+			dir, err := ResolveDir(*moveSession.Dir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !IsWithinDirs(dir, allowedDirs) {
+				http.Error(w, fmt.Sprintf("%s is not an allowed directory", *moveSession.Dir), http.StatusForbidden)
+				return
+			}
+			moveSession.Dir = &dir
+			AuditSession(r, *moveSession.Id)
+			result, ok := CallManager(moveSessionReq, moveSessionRes, moveSession, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			w.WriteHeader(int(result.Status))
+			fmt.Fprint(w, result.Message)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Handles /pause-session and /resume-session
+	pauseHandler := func(paused bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "POST":
+				var pauseSession PauseSessionRequest
+				if err := DecodeRequest(r.Body, &pauseSession, *strictJSON); err != nil || pauseSession.Id == nil {
+					http.Error(w, "Invalid pause session object", http.StatusBadRequest)
+					return
+				}
+				pauseSession.Paused = paused
+				AuditSession(r, *pauseSession.Id)
+				result, ok := CallManager(pauseSessionReq, pauseSessionRes, pauseSession, *managerTimeout)
+				if !ok {
+					http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Add("Status", fmt.Sprint(result.Status))
+				w.WriteHeader(int(result.Status))
+				fmt.Fprint(w, result.Message)
+			default:
+				http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+			}
+		}
+	}
+	http.HandleFunc("/pause-session", pauseHandler(true))
+	http.HandleFunc("/resume-session", pauseHandler(false))
+
+	http.HandleFunc("/rotate-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var rotateSession RotateSessionRequest
+			if err := DecodeRequest(r.Body, &rotateSession, *strictJSON); err != nil || rotateSession.Id == nil {
+				http.Error(w, "Invalid rotate session object", http.StatusBadRequest)
+				return
+			}
+			AuditSession(r, *rotateSession.Id)
+			result, ok := CallManager(rotateSessionReq, rotateSessionRes, rotateSession, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			if result.Status != http.StatusOK {
+				w.WriteHeader(int(result.Status))
+				fmt.Fprint(w, result.Message)
+				return
+			}
+			fmt.Printf("Rotated session %s to %s request_id=%s\n", rotateSession.Id.String(), result.RotatedPath, RequestId(r))
+			if *hideFilepaths {
+				result.RotatedPath = Redacted
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(result)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/update-tags", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PATCH":
+			var updateTags UpdateTagsRequest
+			if err := DecodeRequest(r.Body, &updateTags, *strictJSON); err != nil || updateTags.Id == nil {
+				http.Error(w, "Invalid update tags object", http.StatusBadRequest)
+				return
+			}
+			updateTags.Mode = r.URL.Query().Get("mode")
+			if updateTags.Mode == "" {
+				updateTags.Mode = TagsMerge
+			}
+			if updateTags.Mode != TagsMerge && updateTags.Mode != TagsReplace {
+				http.Error(w, fmt.Sprintf("mode must be %q or %q", TagsMerge, TagsReplace), http.StatusBadRequest)
+				return
+			}
+			if err := ValidateTags(updateTags.Tags, updateTags.Mode == TagsMerge); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			AuditSession(r, *updateTags.Id)
+			result, ok := CallManager(updateTagsReq, updateTagsRes, updateTags, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("Status", fmt.Sprint(result.Status))
+			if result.Status != http.StatusOK {
+				w.WriteHeader(int(result.Status))
+				fmt.Fprint(w, result.Message)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(result)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/close-by-tag", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var closeByTag CloseByTagRequest
+			if err := DecodeRequest(r.Body, &closeByTag, *strictJSON); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if closeByTag.Tag == nil {
+				http.Error(w, "Invalid close by tag object", http.StatusBadRequest)
+				return
+			}
+			if _, _, ok := ParseTag(*closeByTag.Tag); !ok {
+				http.Error(w, "Tag must be in the form key=value", http.StatusBadRequest)
+				return
+			}
+			result, ok := CallManager(closeByTagReq, closeByTagRes, closeByTag, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(result)
+			fmt.Printf("Closed %d session(s) with tag %s request_id=%s\n", result.Count, *closeByTag.Tag, RequestId(r))
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/session-errors", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			id, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "Invalid session id", http.StatusBadRequest)
+				return
+			}
+			result, ok := CallManager(sessionErrorsReq, sessionErrorsRes, id, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			if !result.Exists {
+				http.Error(w, fmt.Sprintf("Session id %s does not exist", id.String()), http.StatusNotFound)
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(ListWriteErrors{result.Errors})
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/read-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			result, ok := lookupFileSession(w, r)
+			if !ok {
+				return
+			}
+			asArray := r.URL.Query().Get("as") == "array"
+			if asArray && result.Session.Format != FormatJSON {
+				http.Error(w, "as=array is only supported for json sessions", http.StatusBadRequest)
+				return
+			}
+			mediaType := "text/plain"
+			if result.Session.Format == FormatJSON {
+				mediaType = "application/x-ndjson"
+			}
+			if override := r.URL.Query().Get("content-type"); override != "" {
+				var err error
+				if mediaType, _, err = mime.ParseMediaType(override); err != nil || !IsReadContentType(mediaType) {
+					http.Error(w, fmt.Sprintf("content-type must be one of %s", strings.Join(ReadContentTypes, ", ")), http.StatusBadRequest)
+					return
+				}
+			}
+			// The file's own charset, whatever the override said
+			contentType := mediaType
+			if strings.HasPrefix(mediaType, "text/") {
+				contentType = mime.FormatMediaType(mediaType, map[string]string{"charset": MIMECharsets[result.Session.Charset]})
+			}
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			var offset int64
+			if value := r.URL.Query().Get("offset"); value != "" {
+				var err error
+				if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 {
+					http.Error(w, "offset must be a non-negative byte offset", http.StatusBadRequest)
+					return
+				}
+			}
+
+			var from *regexp.Regexp
+			if value := r.URL.Query().Get("from"); value != "" {
+				var err error
+				if from, err = regexp.Compile(value); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid from pattern: %s", err.Error()), http.StatusBadRequest)
+					return
+				}
+				// The file is sent as it is, so its lines aren't decoded to match against
+				if result.Session.Charset != CharsetUTF8 {
+					http.Error(w, fmt.Sprintf("from is only supported for %s sessions", CharsetUTF8), http.StatusBadRequest)
+					return
+				}
+			}
+
+			verify, _ := strconv.ParseBool(r.URL.Query().Get("verify"))
+			if verify && result.Session.Charset != CharsetUTF8 {
+				http.Error(w, fmt.Sprintf("Only %s sessions can be verified", CharsetUTF8), http.StatusBadRequest)
+				return
+			}
+			if asArray || verify {
+				contentType = "application/json"
+			}
+			w.Header().Set("Content-Type", contentType)
+			if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); download {
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.log\"", SanitizeFilename(result.Session.Name)))
+			}
+
+			if info, err := StatLogFile(result.Session.Filepath); err == nil {
+				etag := LogETag(info, r.URL.RawQuery)
+				w.Header().Set("ETag", etag)
+				if MatchesETag(r.Header.Get("If-None-Match"), etag) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
 
-type Session struct {
-	Id           uuid.UUID
-	Name         string
-	CreationTime string
-	Filepath     string
-}
+			file, err := OpenSessionLog(result.Session)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Nothing has been written yet
+				if asArray {
+					fmt.Fprint(w, "[]")
+				}
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer file.Close()
+			if err := SkipTo(file, offset); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			var reader io.Reader = file
+			// Lines are re-encoded as JSON, so they're decoded first
+			if asArray && result.Session.Charset == CharsetUTF16LE {
+				reader = NewUTF16LEReader(file)
+			}
+			if from != nil {
+				if reader, err = ReadFromMatch(file, from); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
 
-type ListSession struct {
-	Sessions []Session
-}
+			if verify {
+				result, err := VerifyLines(reader, result.Session.Format)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				ResponseEncoder(w, *pretty).Encode(result)
+				return
+			}
+			if !asArray {
+				io.Copy(w, reader)
+				return
+			}
+			lines, skipped, err := ReadJSONLines(reader)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Add("X-Skipped-Lines", fmt.Sprint(skipped))
+			ResponseEncoder(w, *pretty).Encode(lines)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
-// Checks if there's an error. Returns 'true' if error is not nil.
-func CheckError(err error) bool {
-	if err != nil {
-		log.Fatal(err.Error())
-	}
+	http.HandleFunc("/read-sessions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			var ids []uuid.UUID
+			for _, value := range r.URL.Query()["id"] {
+				id, err := uuid.Parse(value)
+				if err != nil {
+					http.Error(w, "Invalid session id", http.StatusBadRequest)
+					return
+				}
+				ids = append(ids, id)
+			}
+			if len(ids) == 0 {
+				http.Error(w, "At least one id is required", http.StatusBadRequest)
+				return
+			}
 
-	return err == nil
-}
+			// Streamed as {"<id>": {"content": "..."} or {"error": "..."}, ...} so only one chunk of a file is held at once
+			writeError := func(message string) {
+				ResponseEncoder(w, *pretty).Encode(map[string]string{"error": message})
+			}
+			w.Header().Add("Content-Type", "application/json")
+			io.WriteString(w, "{")
+			for i, id := range ids {
+				if i > 0 {
+					io.WriteString(w, ",")
+				}
+				fmt.Fprintf(w, "%q:", id.String())
+				result, ok := CallManager(getSessionReq, getSessionRes, id, *managerTimeout)
+				if !ok {
+					writeError(ManagerUnavailable)
+					continue
+				}
+				if !result.Exists && !result.Closed {
+					writeError(fmt.Sprintf("Session id %s does not exist", id.String()))
+					continue
+				}
+				if result.Session.Ephemeral {
+					writeError("Ephemeral sessions can't be read")
+					continue
+				}
+				file, err := OpenSessionText(result.Session)
+				if errors.Is(err, fs.ErrNotExist) {
+					io.WriteString(w, `{"content":""}`)
+					continue
+				}
+				if err != nil {
+					writeError(err.Error())
+					continue
+				}
+				io.WriteString(w, `{"content":`)
+				err = CopyJSONString(w, file)
+				file.Close()
+				if err != nil {
+					log.Printf("Could not stream %s: %s", result.Session.Filepath, err.Error())
+					return
+				}
+				io.WriteString(w, "}")
+			}
+			io.WriteString(w, "}\n")
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
-// Create file if it doesn't exist. If file already exists or file is created successfully, 'true' will be returned.
-func MaybeCreateFile(path string) bool {
-	if _, err := os.Stat(path); err != nil {
-		if file, err := os.Create(path); err != nil {
-			file.Close()
-			return false
+	http.HandleFunc("/compact-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			result, ok := lookupFileSession(w, r)
+			if !ok {
+				return
+			}
+			if result.Exists {
+				http.Error(w, "Only closed sessions can be compacted, close the session first", http.StatusConflict)
+				return
+			}
+			if result.Session.Sharded {
+				http.Error(w, "Sharded sessions can't be compacted", http.StatusConflict)
+				return
+			}
+			if result.Session.Charset != CharsetUTF8 {
+				http.Error(w, fmt.Sprintf("Only %s sessions can be compacted", CharsetUTF8), http.StatusBadRequest)
+				return
+			}
+			dedupe, _ := strconv.ParseBool(r.URL.Query().Get("dedupe"))
+			removed, err := CompactFile(result.Session.Filepath, dedupe, result.Session.Format, *lineTemplateText == DefaultLineTemplate)
+			if errors.Is(err, fs.ErrNotExist) {
+				if _, gzErr := os.Stat(result.Session.Filepath + ".gz"); gzErr == nil {
+					http.Error(w, "Compressed session files can't be compacted", http.StatusConflict)
+					return
+				}
+				err = nil
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(CompactSessionResponse{result.Session.Id, removed})
+			fmt.Printf("Compacted %s, removed %d line(s) request_id=%s\n", result.Session.Filepath, removed, RequestId(r))
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
 		}
-	}
+	})
 
-	return true
-}
+	http.HandleFunc("/session-offset", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			result, ok := lookupFileSession(w, r)
+			if !ok {
+				return
+			}
 
-func main() {
-	defaultPath, osError := os.Getwd()
-	CheckError(osError)
-	logDir := flag.String("log-dir", defaultPath, "Directory to put all log files")
+			response := SessionOffset{Id: result.Session.Id}
+			info, err := os.Stat(result.Session.Filepath)
+			if result.Session.Sharded {
+				// Offsets count across all the shards
+				response.Offset = int64(result.Session.Bytes)
+			} else if err == nil {
+				response.Offset = info.Size()
+			} else if errors.Is(err, fs.ErrNotExist) {
+				// Either nothing was written yet, or the file was compressed and the stat size would be the compressed one
+				response.Offset = int64(result.Session.Bytes)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
-	// Session related channels
-	createSessionReq := make(chan CreateSessionRequest)
-	createSessionRes := make(chan CreateSessionResponse)
-	listSessionReq := make(chan bool)
-	listSessionRes := make(chan []Session)
-	closeSessionReq := make(chan CloseSessionRequest)
-	closeSessionRes := make(chan CloseSessionResponse)
-	writeSessionReq := make(chan WriteSessionRequest)
-	writeSessionRes := make(chan WriteSessionResponse)
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(response)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
-	// Session manager
-	go func() {
+	http.HandleFunc("/recent-session", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if *memoryTail <= 0 {
+				http.Error(w, "Recent lines aren't kept, start sesh with -memory-tail", http.StatusNotFound)
+				return
+			}
+			id, err := uuid.Parse(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "Invalid session id", http.StatusBadRequest)
+				return
+			}
+			recent, ok := CallManager(recentSessionReq, recentSessionRes, id, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			if !recent.Exists {
+				http.Error(w, fmt.Sprintf("Session id %s is not open", id.String()), http.StatusNotFound)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(recent)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
-		sessions := make(map[uuid.UUID]Session)
+	http.HandleFunc("/session-since", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+			if err != nil {
+				http.Error(w, "seq must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			withLines := r.URL.Query().Get("lines") == "true"
+			lookup := lookupSession
+			if withLines {
+				lookup = lookupFileSession
+			}
+			result, ok := lookup(w, r)
+			if !ok {
+				return
+			}
 
-		for {
-			select {
-			case createSession := <-createSessionReq:
-				id, _ := uuid.NewRandom()
-				creationTime := time.Now().Format(time.RFC3339)
-				sessions[id] = Session{
-					Id:           id,
-					Name:         *createSession.Name,
-					CreationTime: creationTime,
-					Filepath:     filepath.Join(*logDir, fmt.Sprintf("%s-%s-%s", *createSession.Name, creationTime, id.String()[:8])),
+			since := SessionSince{Id: result.Session.Id, Seq: result.Session.Seq}
+			if result.Session.Seq > seq {
+				since.Count = result.Session.Seq - seq
+			}
+			if withLines {
+				if result.Session.Format != FormatJSON && *lineTemplateText != DefaultLineTemplate {
+					http.Error(w, "Lines can only be found by sequence number with the json format or the default -line-template", http.StatusBadRequest)
+					return
 				}
-				createSessionRes <- CreateSessionResponse{id}
-			case <-listSessionReq:
-				var results []Session
-				for k := range sessions {
-					results = append(results, sessions[k])
+				since.Lines = []string{}
+				file, err := OpenSessionText(result.Session)
+				if err == nil {
+					since.Lines, err = LinesSince(file, result.Session.Format, seq)
+					file.Close()
 				}
-				listSessionRes <- results
-			case closeSession := <-closeSessionReq:
-				id := *closeSession.Id
-				_, exists := sessions[id]
-				if exists {
-					delete(sessions, id)
-					closeSessionRes <- CloseSessionResponse{fmt.Sprintf("Successfully closed session with id %s\n", id.String()), http.StatusOK}
-				} else {
-					closeSessionRes <- CloseSessionResponse{fmt.Sprintf("Session id %s does not exist\n", id.String()), http.StatusBadRequest}
+				if err != nil && !errors.Is(err, fs.ErrNotExist) {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
 				}
-			case writeSession := <-writeSessionReq:
-				id := *writeSession.Id
-				session := sessions[id]
+			}
 
-				if !MaybeCreateFile(session.Filepath) {
-					writeSessionRes <- WriteSessionResponse{"File could not be created", http.StatusInternalServerError}
-					continue
-				}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(since)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/session-stat", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			result, ok := lookupFileSession(w, r)
+			if !ok {
+				return
+			}
 
-				file, openErr := os.OpenFile(session.Filepath, os.O_APPEND|os.O_WRONLY, fs.ModeAppend)
-				if openErr != nil {
-					writeSessionRes <- WriteSessionResponse{fmt.Sprintf("%s\n", openErr.Error()), http.StatusInternalServerError}
+			stat := SessionStat{
+				Id:       result.Session.Id,
+				Filepath: result.Session.Filepath,
+				Lines:    result.Session.Lines,
+				Bytes:    result.Session.Bytes,
+			}
+			var err error
+			if result.Session.Sharded {
+				stat.Size, stat.ModTime, err = StatShards(filepath.Dir(stat.Filepath))
+			} else {
+				var info fs.FileInfo
+				info, err = os.Stat(stat.Filepath)
+				if errors.Is(err, fs.ErrNotExist) {
+					// Compressed on close
+					stat.Filepath += ".gz"
+					info, err = os.Stat(stat.Filepath)
+				}
+				if err == nil {
+					stat.Size = info.Size()
+					stat.ModTime = info.ModTime()
 				}
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				// Nothing written yet
+				stat.Filepath = result.Session.Filepath
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if *hideFilepaths {
+				stat.Filepath = Redacted
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(stat)
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
-				logStatement := fmt.Sprintf("%s Log: %s\n", time.Now().Format(time.RFC3339Nano), *writeSession.Content)
-				if _, writeErr := file.WriteString(logStatement); writeErr != nil {
-					writeSessionRes <- WriteSessionResponse{fmt.Sprintf("%s\n", writeErr.Error()), http.StatusInternalServerError}
+	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ids := make(map[uuid.UUID]bool)
+			for _, value := range r.URL.Query()["id"] {
+				id, err := uuid.Parse(value)
+				if err != nil {
+					http.Error(w, "Invalid session id", http.StatusBadRequest)
+					return
+				}
+				ids[id] = true
+			}
+			tagKey, tagValue, filterByTag := "", "", r.URL.Query().Has("tag")
+			if filterByTag {
+				var ok bool
+				if tagKey, tagValue, ok = ParseTag(r.URL.Query().Get("tag")); !ok {
+					http.Error(w, "Tag must be in the form key=value", http.StatusBadRequest)
+					return
 				}
+			}
 
-				file.Sync()
-				file.Close()
+			sessions, ok := CallManager(listSessionReq, listSessionRes, true, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			sort.Slice(sessions, func(i, j int) bool { return sessions[i].Filepath < sessions[j].Filepath })
+			var sources []LogSource
+			for _, session := range sessions {
+				if session.Ephemeral || (len(ids) > 0 && !ids[session.Id]) {
+					continue
+				}
+				if value, ok := session.Tags[tagKey]; filterByTag && (!ok || value != tagValue) {
+					continue
+				}
+				sources = append(sources, SessionLogSource(session))
+			}
 
-				writeSessionRes <- WriteSessionResponse{"", http.StatusOK}
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			if err := MergeLogs(w, sources); err != nil {
+				log.Printf("Could not stream merged logs: %s", err.Error())
 			}
+		default:
+			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
 		}
+	})
 
-	}()
-
-	http.HandleFunc("/create-session", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/read-tree", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
-		case "POST":
-			decoder := json.NewDecoder(r.Body)
-			var newSession CreateSessionRequest
-			err := decoder.Decode(&newSession)
+		case "GET":
+			id, err := uuid.Parse(r.URL.Query().Get("id"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				http.Error(w, "Invalid session id", http.StatusBadRequest)
 				return
 			}
-			if newSession.Name == nil {
-				http.Error(w, "Invalid create session object", http.StatusBadRequest)
+
+			tree, ok := CallManager(sessionTreeReq, sessionTreeRes, id, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			if len(tree) == 0 {
+				http.Error(w, fmt.Sprintf("Session id %s does not exist", id.String()), http.StatusNotFound)
 				return
 			}
-			createSessionReq <- newSession
-			response := <-createSessionRes
+			var sources []LogSource
+			for _, session := range tree {
+				if !session.Ephemeral {
+					sources = append(sources, SessionLogSource(session))
+				}
+			}
 
-			json.NewEncoder(w).Encode(response)
-			w.Header().Add("Content-Type", "application/json")
-			w.Header().Add("Status", fmt.Sprint(http.StatusOK))
-			fmt.Printf("Session created with id=%s\n", response.Id)
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			if err := MergeLogs(w, sources); err != nil {
+				log.Printf("Could not stream merged logs of %s: %s", id.String(), err.Error())
+			}
 		default:
 			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	http.HandleFunc("/list-sessions", func(w http.ResponseWriter, r *http.Request) {
+	var openAPISpec bytes.Buffer
+	specErr := ResponseEncoder(&openAPISpec, *pretty).Encode(OpenAPISpec())
+	CheckError(specErr)
+
+	http.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
+			sessions, ok := CallManager(listSessionReq, listSessionRes, true, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			response := WhoAmIResponse{Identity: ClientIdentity(r)}
+			for _, session := range sessions {
+				if response.Identity != "" && session.Owner == response.Identity {
+					response.SessionsOwned++
+				}
+			}
+			if createLimiter != nil {
+				remaining := createLimiter.Remaining()
+				response.CreatesRemaining = &remaining
+			}
 			w.Header().Add("Content-Type", "application/json")
-			listSessionReq <- true
-			sessions := <-listSessionRes
-			json.NewEncoder(w).Encode(ListSession{sessions})
-			w.Header().Add("Status", fmt.Sprint(http.StatusOK))
+			ResponseEncoder(w, *pretty).Encode(response)
 		default:
 			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	http.HandleFunc("/close-session", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
-		case "POST":
-			var closeSession CloseSessionRequest
-			json.NewDecoder(r.Body).Decode(&closeSession)
-			closeSessionReq <- closeSession
-			result := <-closeSessionRes
-			w.Header().Add("Status", fmt.Sprint(result.Status))
-			fmt.Fprintf(w, result.Message)
+		case "GET":
+			w.Header().Add("Content-Type", "application/json")
+			w.Write(openAPISpec.Bytes())
 		default:
 			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	http.HandleFunc("/write-session", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
-		case "POST":
-			var writeSession WriteSessionRequest
-			json.NewDecoder(r.Body).Decode(&writeSession)
-			writeSessionReq <- writeSession
-			result := <-writeSessionRes
-			w.Header().Add("Status", fmt.Sprint(result.Status))
-			fmt.Fprintf(w, result.Message)
+		case "GET":
+			// Reloadable flags are owned by the manager, so read them there
+			config, ok := CallManager(configReq, configRes, true, *managerTimeout)
+			if !ok {
+				http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
+			ResponseEncoder(w, *pretty).Encode(config)
 		default:
 			http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	err := http.ListenAndServe(":8080", nil)
+	if *debug {
+		http.HandleFunc("/debug/sessions", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET":
+				state, ok := CallManager(debugReq, debugRes, true, *managerTimeout)
+				if !ok {
+					http.Error(w, ManagerUnavailable, http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				ResponseEncoder(w, *pretty).Encode(state)
+			default:
+				http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+	}
+
+	if integrity != nil {
+		http.HandleFunc("/integrity", func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET":
+				report := integrity.Report()
+				if *hideFilepaths {
+					problems := make([]IntegrityProblem, len(report.Problems))
+					for i, problem := range report.Problems {
+						problem.Filepath = Redacted
+						problems[i] = problem
+					}
+					report.Problems = problems
+				}
+				w.Header().Add("Content-Type", "application/json")
+				ResponseEncoder(w, *pretty).Encode(report)
+			default:
+				http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+	}
+
+	var handler http.Handler = http.DefaultServeMux
+	if *readOnly {
+		handler = WithReadOnly(handler)
+	}
+	if *auditFile != "" {
+		audit, err := OpenAuditLog(*auditFile)
+		CheckError(err)
+		handler = WithAudit(handler, audit)
+	}
+	signed := WithVars(handler)
+	if *hmacSecret != "" {
+		signed = WithSignature(signed, []byte(*hmacSecret))
+	}
+	server := &http.Server{
+		Addr:        *addr,
+		Handler:     WithRequestId(signed),
+		IdleTimeout: *idleTimeout,
+	}
+	server.SetKeepAlivesEnabled(*keepalive)
+	shutdown := make(chan bool)
+	go func() {
+		stops := make(chan os.Signal, 1)
+		signal.Notify(stops, os.Interrupt, syscall.SIGTERM)
+		<-stops
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Requests still running after %s: %s", *shutdownTimeout, err.Error())
+		}
+		close(shutdown)
+	}()
+	listener, err := Listen(*addr, *reusePort, *listenBacklog)
 	CheckError(err)
+	if *maxConnections > 0 {
+		listener = NewLimitListener(listener, *maxConnections)
+	}
+	if *tlsCert != "" {
+		// net/http negotiates HTTP/2 over TLS by default
+		err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		CheckError(err)
+	}
+	<-shutdown
+	fmt.Printf("Shutting down, %s\n", CountersSummary(time.Since(started)))
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Writes to /dev/full fail with ENOSPC, as they would on a full disk.
+func TestWriteDiskFull(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"full"}`)
+	if err := os.Symlink("/dev/full", s.path(session)); err != nil {
+		t.Fatal(err)
+	}
+
+	res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"no room"}`, session.Id.String()))
+	if res.StatusCode != http.StatusInsufficientStorage || !strings.HasPrefix(read, "Disk full") {
+		t.Errorf("got %d %s", res.StatusCode, read)
+	}
+}
+
+// Sessions hold no open file handles between writes, so any number of them can be written to without running out.
+func TestWritesLeaveNoOpenFiles(t *testing.T) {
+	s := startServer(t)
+	openFiles := func() int {
+		return len(listDir(t, fmt.Sprintf("/proc/%d/fd", s.cmd.Process.Pid)))
+	}
+	warm := s.create(t, `{"name":"warm"}`)
+	s.write(t, warm.Id, "first")
+	before := openFiles()
+
+	var sessions []Session
+	for i := 0; i < 50; i++ {
+		session := s.create(t, fmt.Sprintf(`{"name":"many-%d"}`, i))
+		s.write(t, session.Id, "one")
+		s.write(t, session.Id, "two")
+		sessions = append(sessions, session)
+	}
+	// Idle keep-alive connections may add a few
+	if after := openFiles(); after > before+5 {
+		t.Errorf("%d open files before, %d after writing to 50 sessions", before, after)
+	}
+	for _, session := range sessions {
+		if lines := readLines(t, s.path(session)); len(lines) != 2 {
+			t.Fatalf("%s: got %q", session.Name, lines)
+		}
+	}
+}
@@ -0,0 +1,2018 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFormatLineCustomTemplate(t *testing.T) {
+	tmpl, err := ParseLineTemplate("<{{.SessionName}}> {{.Seq}}: {{.Content}} ({{.SessionId}})")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := FormatLine(tmpl, LineData{Time: "now", Seq: 3, Content: "hello", SessionId: "abc", SessionName: "build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<build> 3: hello (abc)\n"; line != want {
+		t.Errorf("got %q, want %q", line, want)
+	}
+}
+
+func TestParseLineTemplateRejectsUnknownField(t *testing.T) {
+	if _, err := ParseLineTemplate("{{.Nope}}"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestWriteWithLineTemplate(t *testing.T) {
+	s := startServer(t, "-line-template", "[{{.SessionName}}] {{.Content}}")
+	session := s.create(t, `{"name":"build"}`)
+	s.write(t, session.Id, "hello")
+
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || lines[0] != "[build] hello" {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var patterns RegexpList
+	patterns.Set(`sk-[a-z0-9]{12}`)
+	if got := Redact("token sk-abcdefghijkl used", patterns); got != "token *** used" {
+		t.Errorf("got %q", got)
+	}
+	fields := RedactFields(map[string]interface{}{"auth": "sk-abcdefghijkl", "n": 1.0}, patterns)
+	if fields["auth"] != RedactedMarker || fields["n"] != 1.0 {
+		t.Errorf("got %v", fields)
+	}
+}
+
+func TestWriteRedactsSecrets(t *testing.T) {
+	s := startServer(t, "-redact-patterns", `sk-[a-z0-9]{12}`)
+	session := s.create(t, `{"name":"secrets"}`)
+	s.write(t, session.Id, "token sk-abcdefghijkl used")
+
+	if read := s.read(t, session.Id); !strings.Contains(read, "token *** used") || strings.Contains(read, "sk-") {
+		t.Errorf("got %q", read)
+	}
+}
+
+func TestWriteRedactsBeforeTruncating(t *testing.T) {
+	s := startServer(t, "-max-line-length", "10", "-redact-patterns", `sk-[a-z0-9]{12}`)
+	session := s.create(t, `{"name":"secrets"}`)
+	s.write(t, session.Id, "sk-abcdefghijkl")
+
+	if read := s.read(t, session.Id); strings.Contains(read, "sk-") || !strings.Contains(read, "Log: ***\n") {
+		t.Errorf("got %q", read)
+	}
+}
+
+func TestSessionTreeOrder(t *testing.T) {
+	root := Session{Id: uuid.New()}
+	child := Session{Id: uuid.New(), ParentId: &root.Id, CreationTime: "2026-10-14T00:00:02Z"}
+	older := Session{Id: uuid.New(), ParentId: &root.Id, CreationTime: "2026-10-14T00:00:01Z"}
+	grandchild := Session{Id: uuid.New(), ParentId: &child.Id}
+	other := Session{Id: uuid.New()}
+
+	tree := SessionTree([]Session{grandchild, root, child, other, older}, root)
+	var got []uuid.UUID
+	for _, session := range tree {
+		got = append(got, session.Id)
+	}
+	if want := []uuid.UUID{root.Id, older.Id, child.Id, grandchild.Id}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadTreeMergesChildren(t *testing.T) {
+	s := startServer(t, "-shard-size", "40")
+	parent := s.create(t, `{"name":"parent"}`)
+	first := s.create(t, fmt.Sprintf(`{"name":"first","parent_id":%q}`, parent.Id))
+	second := s.create(t, fmt.Sprintf(`{"name":"second","parent_id":%q}`, parent.Id))
+	grandchild := s.create(t, fmt.Sprintf(`{"name":"grandchild","parent_id":%q}`, first.Id))
+	unrelated := s.create(t, `{"name":"unrelated"}`)
+	writes := []struct {
+		session Session
+		content string
+		second  int
+	}{
+		{second, "c", 3}, {parent, "a", 1}, {first, "b", 2}, {unrelated, "x", 2}, {grandchild, "f", 6}, {first, "e", 5}, {parent, "d", 4},
+	}
+	for _, write := range writes {
+		body := fmt.Sprintf(`{"id":%q,"content":%q,"timestamp":"2026-10-14T00:00:0%dZ"}`, write.session.Id, write.content, write.second)
+		if res, read := s.post(t, "/write-session", body); res.StatusCode != http.StatusOK {
+			t.Fatalf("write: %d %s", res.StatusCode, read)
+		}
+	}
+
+	_, read := s.get(t, "/read-tree?id="+parent.Id.String())
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(read, "\n"), "\n") {
+		name, _, _ := strings.Cut(line, " ")
+		got = append(got, name+line[len(line)-1:])
+	}
+	if want := "[parent]a [first]b [second]c [parent]d [first]e [grandchild]f"; strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, " "), want)
+	}
+
+	if res, _ := s.get(t, "/read-tree?id="+uuid.NewString()); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown id: got %d", res.StatusCode)
+	}
+}
+
+func TestReadTreeIncludesClosedSessions(t *testing.T) {
+	s := startServer(t)
+	parent := s.create(t, `{"name":"parent"}`)
+	child := s.create(t, fmt.Sprintf(`{"name":"child","parent_id":%q}`, parent.Id))
+	s.write(t, parent.Id, "from the parent")
+	s.write(t, child.Id, "from the child")
+	s.close(t, child.Id)
+
+	for _, closeParent := range []bool{false, true} {
+		if closeParent {
+			s.close(t, parent.Id)
+		}
+		res, read := s.get(t, "/read-tree?id="+parent.Id.String())
+		lines := strings.Split(strings.TrimSuffix(read, "\n"), "\n")
+		if res.StatusCode != http.StatusOK || len(lines) != 2 || !strings.HasPrefix(lines[0], "[parent] ") || !strings.HasPrefix(lines[1], "[child] ") {
+			t.Errorf("parent closed %v: got %d %q", closeParent, res.StatusCode, read)
+		}
+	}
+}
+
+func TestWithDeadline(t *testing.T) {
+	release := make(chan struct{})
+	done, err := WithDeadline(20*time.Millisecond, func() error {
+		<-release
+		return nil
+	})
+	if !errors.Is(err, ErrWriteDeadline) {
+		t.Fatalf("slow write: got %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("done before the abandoned write returned")
+	default:
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("done not closed after the abandoned write returned")
+	}
+
+	failed := errors.New("failed")
+	if _, err := WithDeadline(time.Second, func() error { return failed }); err != failed {
+		t.Errorf("fast write: got %v", err)
+	}
+	if _, err := WithDeadline(0, func() error { return failed }); err != failed {
+		t.Errorf("no deadline: got %v", err)
+	}
+}
+
+func TestReplayContent(t *testing.T) {
+	summed, _ := AddChecksum("2026-10-14T00:00:00Z [3] Log: hello k=v\n", FormatText, "crc32")
+	for _, test := range []struct {
+		line    string
+		format  string
+		framed  bool
+		content string
+		fields  map[string]interface{}
+	}{
+		{"2026-10-14T00:00:00Z [3] Log: hello\n", FormatText, true, "hello", nil},
+		{"2026-10-14T00:00:00Z [3] Log: hello\n", FormatText, false, "2026-10-14T00:00:00Z [3] Log: hello", nil},
+		{summed, FormatText, true, "hello k=v", nil},
+		{"continued\n", FormatText, true, "continued", nil},
+		{`{"time":"2026-10-14T00:00:00Z","seq":3,"content":"hello","level":"info","checksum":"crc32:00"}` + "\n", FormatJSON, true, "hello", map[string]interface{}{"level": "info"}},
+	} {
+		content, fields := ReplayContent([]byte(test.line), test.format, test.framed)
+		if content != test.content || fmt.Sprint(fields) != fmt.Sprint(test.fields) {
+			t.Errorf("%q: got %q %v, want %q %v", test.line, content, fields, test.content, test.fields)
+		}
+	}
+}
+
+func TestReplayKeepsContentAndTimes(t *testing.T) {
+	s := startServer(t)
+	for _, format := range []string{FormatText, FormatJSON} {
+		source := s.create(t, fmt.Sprintf(`{"name":"source","format":%q}`, format))
+		target := s.create(t, fmt.Sprintf(`{"name":"target","format":%q}`, format))
+		for i, content := range []string{"first", "second"} {
+			body := fmt.Sprintf(`{"id":%q,"content":%q,"timestamp":"2026-10-14T00:00:0%dZ"}`, source.Id, content, i+1)
+			if res, read := s.post(t, "/write-session", body); res.StatusCode != http.StatusOK {
+				t.Fatalf("write: %d %s", res.StatusCode, read)
+			}
+		}
+
+		res, read := s.post(t, "/replay", fmt.Sprintf(`{"source_id":%q,"target_id":%q}`, source.Id, target.Id))
+		var replayed ReplaySessionResponse
+		decode(t, read, &replayed)
+		if res.StatusCode != http.StatusOK || replayed.Lines != 2 {
+			t.Fatalf("%s replay: %d %s", format, res.StatusCode, read)
+		}
+		if got, want := s.read(t, target.Id), s.read(t, source.Id); got != want {
+			t.Errorf("%s: replayed %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestCompressOnClose(t *testing.T) {
+	s := startServer(t, "-compress-on-close")
+	session := s.create(t, `{"name":"compressed"}`)
+	s.write(t, session.Id, "hello")
+	s.close(t, session.Id)
+
+	path := s.path(session) + ".gz"
+	eventually(t, 5*time.Second, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read, err := io.ReadAll(reader); err != nil || !strings.HasSuffix(string(read), "Log: hello\n") {
+		t.Errorf("got %q, %v", read, err)
+	}
+	if _, err := os.Stat(s.path(session)); !os.IsNotExist(err) {
+		t.Errorf("uncompressed file left behind: %v", err)
+	}
+	if read := s.read(t, session.Id); !strings.HasSuffix(read, "Log: hello\n") {
+		t.Errorf("read after close: got %q", read)
+	}
+}
+
+func TestMaxClosedSessions(t *testing.T) {
+	s := startServer(t, "-max-closed-sessions", "2", "-debug")
+	var closed []Session
+	for i := 0; i < 3; i++ {
+		session := s.create(t, fmt.Sprintf(`{"name":"closed-%d"}`, i))
+		s.write(t, session.Id, "hello")
+		s.close(t, session.Id)
+		closed = append(closed, session)
+	}
+
+	if res, _ := s.get(t, "/read-session?id="+closed[0].Id.String()); res.StatusCode != http.StatusNotFound {
+		t.Errorf("oldest closed session: got %d", res.StatusCode)
+	}
+	for _, session := range closed[1:] {
+		s.read(t, session.Id)
+	}
+	var state DebugState
+	_, read := s.get(t, "/debug/sessions")
+	decode(t, read, &state)
+	if len(state.ClosedSessions) != 2 {
+		t.Errorf("got %d closed sessions", len(state.ClosedSessions))
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		format  string
+		dedupe  bool
+		input   string
+		output  string
+		removed int
+	}{
+		{"blank lines", FormatText, false,
+			"2026-10-14T00:00:01Z [1] Log: a\n\n  \n2026-10-14T00:00:02Z [2] Log: a\n",
+			"2026-10-14T00:00:01Z [1] Log: a\n2026-10-14T00:00:02Z [2] Log: a\n", 2},
+		{"dedupe text", FormatText, true,
+			"2026-10-14T00:00:01Z [1] Log: a\n2026-10-14T00:00:02Z [2] Log: b\n2026-10-14T00:00:03Z [3] Log: a\n",
+			"2026-10-14T00:00:01Z [1] Log: a\n2026-10-14T00:00:02Z [2] Log: b\n", 1},
+		{"dedupe multi-line text", FormatText, true,
+			"2026-10-14T00:00:01Z [1] Log: a\ny\n2026-10-14T00:00:02Z [2] Log: b\ny\n2026-10-14T00:00:03Z [3] Log: a\ny\n",
+			"2026-10-14T00:00:01Z [1] Log: a\ny\n2026-10-14T00:00:02Z [2] Log: b\ny\n", 2},
+		{"dedupe json", FormatJSON, true,
+			`{"content":"a","seq":1,"time":"2026-10-14T00:00:01Z"}` + "\n" + `{"content":"a","level":"warn","seq":2,"time":"2026-10-14T00:00:02Z"}` + "\n" + `{"content":"a","seq":3,"time":"2026-10-14T00:00:03Z"}` + "\n",
+			`{"content":"a","seq":1,"time":"2026-10-14T00:00:01Z"}` + "\n" + `{"content":"a","level":"warn","seq":2,"time":"2026-10-14T00:00:02Z"}` + "\n", 1},
+	} {
+		path := filepath.Join(t.TempDir(), "session.log")
+		os.WriteFile(path, []byte(test.input), 0644)
+		removed, err := CompactFile(path, test.dedupe, test.format, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != test.output || removed != test.removed {
+			t.Errorf("%s: got %q removing %d, want %q removing %d", test.name, data, removed, test.output, test.removed)
+		}
+	}
+}
+
+func TestCompactSessionDedupe(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"compacted"}`)
+	s.write(t, session.Id, "hello")
+	s.write(t, session.Id, "hello")
+	s.write(t, session.Id, "other")
+	s.close(t, session.Id)
+
+	res, read := s.post(t, "/compact-session?dedupe=true&id="+session.Id.String(), "")
+	var compacted CompactSessionResponse
+	decode(t, read, &compacted)
+	if res.StatusCode != http.StatusOK || compacted.Removed != 1 {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 2 || !strings.HasSuffix(lines[0], "Log: hello") || !strings.HasSuffix(lines[1], "Log: other") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestReadSessionContentType(t *testing.T) {
+	s := startServer(t)
+	text := s.create(t, `{"name":"text"}`)
+	ndjson := s.create(t, `{"name":"json","format":"json"}`)
+	wide := s.create(t, `{"name":"wide","charset":"utf16le"}`)
+	for _, session := range []Session{text, ndjson, wide} {
+		s.write(t, session.Id, "<script>alert(1)</script>")
+	}
+
+	for _, test := range []struct {
+		session     Session
+		query       string
+		status      int
+		contentType string
+	}{
+		{text, "", http.StatusOK, "text/plain; charset=utf-8"},
+		{ndjson, "", http.StatusOK, "application/x-ndjson"},
+		{wide, "", http.StatusOK, "text/plain; charset=utf-16le"},
+		{text, "&content-type=application/octet-stream", http.StatusOK, "application/octet-stream"},
+		{text, "&content-type=text/plain;+charset=utf-7", http.StatusOK, "text/plain; charset=utf-8"},
+		{text, "&content-type=text/html", http.StatusBadRequest, ""},
+		{text, "&content-type=image/svg%2Bxml", http.StatusBadRequest, ""},
+	} {
+		res, read := s.get(t, "/read-session?id="+test.session.Id.String()+test.query)
+		if res.StatusCode != test.status {
+			t.Errorf("%s%s: got %d %s", test.session.Name, test.query, res.StatusCode, read)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if got := res.Header.Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s%s: got Content-Type %q, want %q", test.session.Name, test.query, got, test.contentType)
+		}
+		if got := res.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("%s%s: got X-Content-Type-Options %q", test.session.Name, test.query, got)
+		}
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	for tag, want := range map[string][3]string{
+		"team=core": {"team", "core", "true"},
+		"team=":     {"team", "", "true"},
+		"a=b=c":     {"a", "b=c", "true"},
+		"=core":     {"", "", "false"},
+		"team":      {"", "", "false"},
+		"":          {"", "", "false"},
+	} {
+		key, value, ok := ParseTag(tag)
+		if got := [3]string{key, value, fmt.Sprint(ok)}; got != want {
+			t.Errorf("%q: got %v, want %v", tag, got, want)
+		}
+	}
+}
+
+func TestCloseByTag(t *testing.T) {
+	s := startServer(t)
+	first := s.create(t, `{"name":"first","tags":{"team":"core"}}`)
+	second := s.create(t, `{"name":"second","tags":{"team":"core","env":"ci"}}`)
+	other := s.create(t, `{"name":"other","tags":{"team":"web"}}`)
+
+	res, read := s.post(t, "/close-by-tag", `{"tag":"team=core"}`)
+	var closed CloseByTagResponse
+	decode(t, read, &closed)
+	if res.StatusCode != http.StatusOK || closed.Count != 2 || len(closed.Ids) != 2 {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	if ids := sessionIds([]Session{first, second}); !ids[closed.Ids[0].String()] || !ids[closed.Ids[1].String()] {
+		t.Errorf("closed %v", closed.Ids)
+	}
+	if open := s.list(t, "").Sessions; len(open) != 1 || open[0].Id != other.Id {
+		t.Errorf("left open %v", open)
+	}
+
+	if res, _ := s.post(t, "/close-by-tag", `{"tag":"team"}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed tag: got %d", res.StatusCode)
+	}
+}
+
+func TestFormatJSONLineFields(t *testing.T) {
+	line, err := FormatJSONLine("2026-10-14T00:00:00Z", 2, "hello", map[string]interface{}{"user": "ann", "count": 3, "time": "overridden?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]interface{}
+	decode(t, line, &object)
+	if object["user"] != "ann" || object["count"] != 3.0 || object["time"] != "2026-10-14T00:00:00Z" || object["seq"] != 2.0 || object["content"] != "hello" {
+		t.Errorf("got %s", line)
+	}
+}
+
+func TestAppendFields(t *testing.T) {
+	if got := AppendFields("hello", map[string]interface{}{"b": 2, "a": "x"}); got != "hello a=x b=2" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWriteFields(t *testing.T) {
+	s := startServer(t)
+	for format, want := range map[string]string{FormatJSON: `"user":"ann"`, FormatText: "Log: hello count=3 user=ann"} {
+		session := s.create(t, fmt.Sprintf(`{"name":"fields","format":%q}`, format))
+		body := fmt.Sprintf(`{"id":%q,"content":"hello","fields":{"user":"ann","count":3}}`, session.Id)
+		if res, read := s.post(t, "/write-session", body); res.StatusCode != http.StatusOK {
+			t.Fatalf("write: %d %s", res.StatusCode, read)
+		}
+		if read := s.read(t, session.Id); !strings.Contains(read, want) {
+			t.Errorf("%s: got %q, want it to contain %q", format, read, want)
+		}
+	}
+}
+
+func TestNoSyncWarnsOnce(t *testing.T) {
+	s := startServer(t, "-no-sync")
+	session := s.create(t, `{"name":"unsynced"}`)
+	s.write(t, session.Id, "hello")
+	s.write(t, session.Id, "again")
+	s.stop()
+
+	stdout, _ := s.wait(t)
+	if count := strings.Count(stdout, "WARNING: -no-sync"); count != 1 {
+		t.Errorf("warned %d times: %s", count, stdout)
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 2 {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func BenchmarkAppendToFile(b *testing.B) {
+	for _, sync := range []bool{true, false} {
+		b.Run(fmt.Sprintf("sync=%v", sync), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "session.log")
+			line := "2026-10-14T00:00:00Z [1] Log: a line of benchmark content\n"
+			b.SetBytes(int64(len(line)))
+			for i := 0; i < b.N; i++ {
+				if err := AppendToFile(path, line, sync); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncateContent(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		max     int
+		want    string
+	}{
+		{"abcdefgh", 4, "abcd" + TruncatedMarker},
+		// Cuts before the 3 byte sequence for the euro sign rather than inside it
+		{"ab€cd", 4, "ab" + TruncatedMarker},
+		{"ab€cd", 5, "ab€" + TruncatedMarker},
+	} {
+		if got := TruncateContent(test.content, test.max); got != test.want {
+			t.Errorf("%q to %d: got %q, want %q", test.content, test.max, got, test.want)
+		}
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	for _, mode := range []string{OversizeTruncate, OversizeReject} {
+		s := startServer(t, "-max-line-length", "5", "-on-oversize", mode)
+		session := s.create(t, `{"name":"oversized"}`)
+		res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"0123456789"}`, session.Id))
+		s.write(t, session.Id, "short")
+
+		lines := readLines(t, s.path(session))
+		switch mode {
+		case OversizeTruncate:
+			if res.StatusCode != http.StatusOK || len(lines) != 2 || !strings.HasSuffix(lines[0], "Log: 01234"+TruncatedMarker) {
+				t.Errorf("truncate: got %d %s, lines %q", res.StatusCode, read, lines)
+			}
+		case OversizeReject:
+			if res.StatusCode != http.StatusBadRequest || len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: short") {
+				t.Errorf("reject: got %d %s, lines %q", res.StatusCode, read, lines)
+			}
+		}
+	}
+}
+
+func TestRecordWriteError(t *testing.T) {
+	var history []WriteError
+	for i := 0; i < 5; i++ {
+		history = RecordWriteError(history, WriteError{Message: fmt.Sprint(i)}, 3)
+	}
+	if len(history) != 3 || history[0].Message != "2" || history[2].Message != "4" {
+		t.Errorf("got %v", history)
+	}
+	if history := RecordWriteError(nil, WriteError{}, 0); history != nil {
+		t.Errorf("limit 0: got %v", history)
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"failing"}`)
+	// A directory where the file should be makes every write fail
+	if err := os.Mkdir(s.path(session), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"lost"}`, session.Id)); res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("write: got %d %s", res.StatusCode, read)
+	}
+
+	res, read := s.get(t, "/session-errors?id="+session.Id.String())
+	var writeErrors ListWriteErrors
+	decode(t, read, &writeErrors)
+	if res.StatusCode != http.StatusOK || len(writeErrors.Errors) != 1 || writeErrors.Errors[0].Message == "" {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, writeErrors.Errors[0].Time); err != nil {
+		t.Errorf("error time: %s", err.Error())
+	}
+
+	s.close(t, session.Id)
+	if res, _ := s.get(t, "/session-errors?id="+session.Id.String()); res.StatusCode != http.StatusNotFound {
+		t.Errorf("after close: got %d", res.StatusCode)
+	}
+}
+
+func TestReadJSONLines(t *testing.T) {
+	lines, skipped, err := ReadJSONLines(strings.NewReader("{\"a\":1}\nnot json\n\n{\"b\":2}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || string(lines[0]) != `{"a":1}` || string(lines[1]) != `{"b":2}` || skipped != 1 {
+		t.Errorf("got %s, skipped %d", lines, skipped)
+	}
+}
+
+func TestReadSessionAsArray(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"array","format":"json"}`)
+	if res, read := s.get(t, "/read-session?as=array&id="+session.Id.String()); res.StatusCode != http.StatusOK || strings.TrimSpace(read) != "[]" {
+		t.Errorf("before writes: got %d %q", res.StatusCode, read)
+	}
+	s.write(t, session.Id, "first")
+	s.write(t, session.Id, "second")
+	f, _ := os.OpenFile(s.path(session), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("malformed\n")
+	f.Close()
+
+	res, read := s.get(t, "/read-session?as=array&id="+session.Id.String())
+	var lines []struct {
+		Seq     int    `json:"seq"`
+		Content string `json:"content"`
+	}
+	decode(t, read, &lines)
+	if res.Header.Get("Content-Type") != "application/json" || res.Header.Get("X-Skipped-Lines") != "1" {
+		t.Errorf("got headers %v", res.Header)
+	}
+	if len(lines) != 2 || lines[0].Content != "first" || lines[1].Content != "second" || lines[1].Seq != 2 {
+		t.Errorf("got %s", read)
+	}
+
+	text := s.create(t, `{"name":"text"}`)
+	if res, _ := s.get(t, "/read-session?as=array&id="+text.Id.String()); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("text session: got %d", res.StatusCode)
+	}
+}
+
+func TestDefaultName(t *testing.T) {
+	s := startServer(t, "-default-name", "unnamed")
+	if session := s.create(t, `{}`); session.Name != "unnamed" {
+		t.Errorf("got name %q", session.Name)
+	}
+	if session := s.create(t, `{"name":"given"}`); session.Name != "given" {
+		t.Errorf("got name %q", session.Name)
+	}
+
+	required := startServer(t)
+	if res, read := required.post(t, "/create-session", `{}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("without -default-name: got %d %s", res.StatusCode, read)
+	}
+}
+
+func TestLineSeq(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		format string
+		seq    uint64
+		ok     bool
+	}{
+		{"2026-10-14T00:00:00Z [12] Log: hello", FormatText, 12, true},
+		{"continued content", FormatText, 0, false},
+		{`{"seq":7,"content":"hello"}`, FormatJSON, 7, true},
+		{`{"content":"no seq"}`, FormatJSON, 0, false},
+	} {
+		if seq, ok := LineSeq(test.line, test.format); seq != test.seq || ok != test.ok {
+			t.Errorf("%q: got %d %v", test.line, seq, ok)
+		}
+	}
+}
+
+func TestSequenceNumbersIncrement(t *testing.T) {
+	s := startServer(t)
+	for _, format := range []string{FormatText, FormatJSON} {
+		session := s.create(t, fmt.Sprintf(`{"name":"seq","format":%q}`, format))
+		for i := 0; i < 3; i++ {
+			s.write(t, session.Id, "line")
+		}
+		for i, line := range readLines(t, s.path(session)) {
+			if seq, ok := LineSeq(line, format); !ok || seq != uint64(i+1) {
+				t.Errorf("%s line %d: got seq %d in %q", format, i+1, seq, line)
+			}
+		}
+	}
+}
+
+func TestRetentionSweep(t *testing.T) {
+	s := startServer(t, "-retention", "1h", "-sweep-interval", "50ms")
+	old := time.Now().Add(-2 * time.Hour)
+	expired := filepath.Join(s.Dir, "build-2026-10-01T00:00:00Z-0123abcd")
+	rolled := filepath.Join(s.Dir, "build-2026-10-01T00:00:00Z-0123abcd.2026-10-01.gz")
+	unrelated := filepath.Join(s.Dir, "notes.txt")
+	for _, path := range []string{expired, rolled, unrelated} {
+		os.WriteFile(path, []byte("old\n"), 0644)
+		os.Chtimes(path, old, old)
+	}
+	// The file of an open session is kept however old it is
+	session := s.create(t, `{"name":"open"}`)
+	s.write(t, session.Id, "hello")
+	os.Chtimes(s.path(session), old, old)
+
+	eventually(t, 5*time.Second, func() bool {
+		_, err := os.Stat(rolled)
+		return os.IsNotExist(err)
+	})
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired file kept: %v", err)
+	}
+	for _, path := range []string{unrelated, s.path(session)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s deleted: %v", filepath.Base(path), err)
+		}
+	}
+	if stdout := s.stdout.String(); !strings.Contains(stdout, "Deleted "+expired) {
+		t.Errorf("deletion not logged: %s", stdout)
+	}
+}
+
+func TestConfigReflectsFlags(t *testing.T) {
+	s := startServer(t, "-hmac-secret", "hunter2")
+	res, read := s.get(t, "/config")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var config map[string]string
+	decode(t, read, &config)
+	if config["log-dir"] != s.Dir {
+		t.Errorf("log-dir is %q, want %q", config["log-dir"], s.Dir)
+	}
+	if config["hmac-secret"] != Redacted || strings.Contains(read, "hunter2") {
+		t.Errorf("secret not redacted: %s", read)
+	}
+}
+
+func TestWriteWithTimestamp(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"backdated"}`)
+	res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"old news","timestamp":"2001-02-03T04:05:06Z"}`, session.Id.String()))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasPrefix(lines[0], "2001-02-03T04:05:06Z ") {
+		t.Errorf("got %q", lines)
+	}
+
+	res, read = s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"x","timestamp":"yesterday"}`, session.Id.String()))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid timestamp: got %d %s", res.StatusCode, read)
+	}
+}
+
+// Run with -race: the listing is marshaled while other sessions are being written.
+func TestConcurrentCreateListWrite(t *testing.T) {
+	s := startServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := s.create(t, fmt.Sprintf(`{"name":"worker-%d","tags":{"n":"%d"}}`, i, i))
+			for j := 0; j < 10; j++ {
+				s.write(t, session.Id, fmt.Sprintf("line %d", j))
+				s.list(t, "")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if list := s.list(t, ""); len(list.Sessions) != 8 {
+		t.Errorf("got %d sessions", len(list.Sessions))
+	}
+}
+
+func TestMoveSession(t *testing.T) {
+	target := t.TempDir()
+	s := startServer(t, "-allowed-dirs", target)
+	session := s.create(t, `{"name":"mover"}`)
+	s.write(t, session.Id, "before")
+
+	res, read := s.post(t, "/move-session", fmt.Sprintf(`{"id":%q,"dir":%q}`, session.Id.String(), target))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	s.write(t, session.Id, "after")
+
+	if _, err := os.Stat(s.path(session)); !os.IsNotExist(err) {
+		t.Errorf("old file left behind: %v", err)
+	}
+	lines := readLines(t, filepath.Join(target, filepath.Base(session.Filepath)))
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "Log: before") || !strings.HasSuffix(lines[1], "Log: after") {
+		t.Errorf("got %q", lines)
+	}
+
+	res, read = s.post(t, "/move-session", fmt.Sprintf(`{"id":%q,"dir":%q}`, session.Id.String(), t.TempDir()))
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("disallowed dir: got %d %s", res.StatusCode, read)
+	}
+}
+
+func TestTerseCreateResponse(t *testing.T) {
+	for _, terse := range []bool{false, true} {
+		s := startServer(t, fmt.Sprintf("-terse-responses=%v", terse))
+		res, read := s.post(t, "/create-session", `{"name":"brief"}`)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("terse %v: got %d %s", terse, res.StatusCode, read)
+		}
+		var fields map[string]interface{}
+		decode(t, read, &fields)
+		if _, ok := fields["id"]; !ok {
+			t.Errorf("terse %v: no id in %s", terse, read)
+		}
+		if _, named := fields["name"]; named == terse {
+			t.Errorf("terse %v: got %s", terse, read)
+		}
+		if terse && len(fields) != 1 {
+			t.Errorf("terse: got %s", read)
+		}
+	}
+}
+
+func TestIdleFlush(t *testing.T) {
+	s := startServer(t, "-no-sync", "-idle-flush", "100ms", "-debug")
+	session := s.create(t, `{"name":"idle"}`)
+	s.write(t, session.Id, "buffered")
+
+	unsynced := func() bool {
+		var state DebugState
+		_, read := s.get(t, "/debug/sessions")
+		decode(t, read, &state)
+		return len(state.Sessions) == 1 && state.Sessions[0].Unsynced
+	}
+	if !unsynced() {
+		t.Fatal("write was synced immediately with -no-sync")
+	}
+	eventually(t, 5*time.Second, func() bool { return !unsynced() })
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: buffered") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestListActiveWithin(t *testing.T) {
+	s := startServer(t)
+	active := s.create(t, `{"name":"active"}`)
+	s.create(t, `{"name":"idle"}`)
+	time.Sleep(300 * time.Millisecond)
+	s.write(t, active.Id, "still here")
+
+	list := s.list(t, "active_within=200ms")
+	if ids := sessionIds(list.Sessions); len(ids) != 1 || !ids[active.Id.String()] {
+		t.Errorf("got %v", ids)
+	}
+	if res, _ := s.get(t, "/list-sessions?active_within=-1s"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative window: got %d", res.StatusCode)
+	}
+}
+
+func TestWriteReturnsTimestamp(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"stamped"}`)
+	response := s.write(t, session.Id, "when")
+	if _, err := time.Parse(time.RFC3339Nano, response.Timestamp); err != nil {
+		t.Fatalf("got %q: %s", response.Timestamp, err.Error())
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasPrefix(lines[0], response.Timestamp+" ") {
+		t.Errorf("line %q doesn't start with %s", lines, response.Timestamp)
+	}
+}
+
+func TestMaxPerName(t *testing.T) {
+	s := startServer(t, "-max-per-name", "2")
+	first := s.create(t, `{"name":"dupe"}`)
+	s.create(t, `{"name":"dupe"}`)
+	res, read := s.post(t, "/create-session", `{"name":"dupe"}`)
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(read, "unique name") {
+		t.Fatalf("third session: got %d %s", res.StatusCode, read)
+	}
+	s.create(t, `{"name":"other"}`)
+
+	// Closing one frees its slot
+	s.close(t, first.Id)
+	s.create(t, `{"name":"dupe"}`)
+}
+
+func TestSessionStat(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"stat"}`)
+	s.write(t, session.Id, "one")
+	s.write(t, session.Id, "two")
+
+	res, read := s.get(t, "/session-stat?id="+session.Id.String())
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var stat SessionStat
+	decode(t, read, &stat)
+	info, err := os.Stat(s.path(session))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != info.Size() || stat.Bytes != uint64(info.Size()) || stat.Lines != 2 {
+		t.Errorf("got %+v for a %d byte file", stat, info.Size())
+	}
+
+	if res, _ := s.get(t, "/session-stat?id="+uuid.NewString()); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown id: got %d", res.StatusCode)
+	}
+}
+
+func TestStreamSession(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"streamed"}`)
+	var body strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&body, "line %d\n", i)
+	}
+	res, read := s.post(t, "/stream-session?id="+session.Id.String(), body.String())
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var response StreamSessionResponse
+	decode(t, read, &response)
+	if response.Lines != 100 {
+		t.Errorf("got %+v", response)
+	}
+	lines := readLines(t, s.path(session))
+	if len(lines) != 100 || !strings.HasSuffix(lines[99], "[100] Log: line 99") {
+		t.Errorf("got %d lines, last %q", len(lines), lines[len(lines)-1])
+	}
+}
+
+func TestDateLayout(t *testing.T) {
+	s := startServer(t, "-date-layout", "2006/01/02")
+	session := s.create(t, `{"name":"dated"}`)
+	s.write(t, session.Id, "today")
+
+	created, err := time.Parse(time.RFC3339, session.CreationTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(s.Dir, created.Format("2006/01/02"))
+	if filepath.Dir(session.Filepath) != dir {
+		t.Errorf("got %s, want a file in %s", session.Filepath, dir)
+	}
+	if lines := readLines(t, session.Filepath); len(lines) != 1 {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestCreateNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session")
+	if err := CreateNewFile(path); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte("kept\n"), 0644)
+	if err := CreateNewFile(path); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "kept\n" {
+		t.Errorf("existing file changed to %q", data)
+	}
+}
+
+func TestFailIfExistsCreatesFile(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"fresh","fail_if_exists":true}`)
+	if info, err := os.Stat(s.path(session)); err != nil || info.Size() != 0 {
+		t.Fatalf("got %v, %v", info, err)
+	}
+	s.write(t, session.Id, "first")
+	if lines := readLines(t, s.path(session)); len(lines) != 1 {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"twice"}`)
+	s.close(t, session.Id)
+
+	body := fmt.Sprintf(`{"id":%q}`, session.Id.String())
+	if res, read := s.post(t, "/close-session", body); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("strict: got %d %s", res.StatusCode, read)
+	}
+	if res, read := s.post(t, "/close-session?idempotent=true", body); res.StatusCode != http.StatusOK || !strings.Contains(read, "(idempotent)") {
+		t.Errorf("idempotent parameter: got %d %s", res.StatusCode, read)
+	}
+	if res, read := s.post(t, "/close-session", fmt.Sprintf(`{"id":%q,"idempotent":true}`, uuid.NewString())); res.StatusCode != http.StatusOK {
+		t.Errorf("idempotent field: got %d %s", res.StatusCode, read)
+	}
+}
+
+func TestCreateInAllowedDir(t *testing.T) {
+	allowed := t.TempDir()
+	s := startServer(t, "-allowed-dirs", allowed)
+	session := s.create(t, fmt.Sprintf(`{"name":"tenant","dir":%q}`, allowed))
+	s.write(t, session.Id, "inside")
+	if lines := readLines(t, filepath.Join(allowed, filepath.Base(session.Filepath))); len(lines) != 1 {
+		t.Errorf("got %q", lines)
+	}
+
+	outside := t.TempDir()
+	for _, dir := range []string{outside, filepath.Join(allowed, "..")} {
+		res, read := s.post(t, "/create-session", fmt.Sprintf(`{"name":"tenant","dir":%q}`, dir))
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %d %s", dir, res.StatusCode, read)
+		}
+	}
+	if names := listDir(t, outside); len(names) != 0 {
+		t.Errorf("created %v outside the allowed dirs", names)
+	}
+}
+
+func TestIsWithinDirs(t *testing.T) {
+	dirs := []string{"/var/log/sesh", "/srv/tenants/a"}
+	for dir, want := range map[string]bool{
+		"/var/log/sesh":        true,
+		"/var/log/sesh/nested": true,
+		"/var/log/sesh-other":  false,
+		"/srv/tenants":         false,
+		"/srv/tenants/b":       false,
+	} {
+		if got := IsWithinDirs(dir, dirs); got != want {
+			t.Errorf("%s: got %v", dir, got)
+		}
+	}
+}
+
+func TestResumeFromSessionOffset(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"resumable"}`)
+	s.write(t, session.Id, "seen")
+
+	_, read := s.get(t, "/session-offset?id="+session.Id.String())
+	var offset SessionOffset
+	decode(t, read, &offset)
+	if info, _ := os.Stat(s.path(session)); offset.Offset != info.Size() {
+		t.Fatalf("got offset %d for a %d byte file", offset.Offset, info.Size())
+	}
+	s.write(t, session.Id, "new")
+
+	res, read := s.get(t, fmt.Sprintf("/read-session?id=%s&offset=%d", session.Id.String(), offset.Offset))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	if lines := strings.Split(strings.TrimSuffix(read, "\n"), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: new") {
+		t.Errorf("got %q", read)
+	}
+}
+
+func TestListSessionsCSV(t *testing.T) {
+	s := startServer(t)
+	first := s.create(t, `{"name":"first"}`)
+	second := s.create(t, `{"name":"with, comma"}`)
+	formula := s.create(t, `{"name":"=HYPERLINK(\"evil.example\",\"x\")"}`)
+
+	for _, query := range []string{"?format=csv", ""} {
+		res, read := s.get(t, "/list-sessions"+query, "Accept", "text/csv")
+		if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/csv") {
+			t.Errorf("%q: content type %s", query, res.Header.Get("Content-Type"))
+		}
+		records, err := csv.NewReader(strings.NewReader(read)).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 4 || strings.Join(records[0], ",") != "id,name,creation_time,filepath" {
+			t.Fatalf("%q: got %q", query, records)
+		}
+		names := map[string]string{}
+		for _, record := range records[1:] {
+			names[record[0]] = record[1]
+		}
+		if names[first.Id.String()] != "first" || names[second.Id.String()] != "with, comma" || names[formula.Id.String()] != `'=HYPERLINK("evil.example","x")` {
+			t.Errorf("%q: got %q", query, records)
+		}
+	}
+
+	if res, _ := s.get(t, "/list-sessions"); !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("default content type %s", res.Header.Get("Content-Type"))
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	for value, want := range map[string]string{"": "", "job": "job", "=1+1": "'=1+1", "+1": "'+1", "-1": "'-1", "@SUM(A1)": "'@SUM(A1)", "\tx": "'\tx", "a=b": "a=b"} {
+		if got := CSVCell(value); got != want {
+			t.Errorf("%q: got %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestAutoName(t *testing.T) {
+	s := startServer(t, "-auto-name")
+	for i := 1; i <= 3; i++ {
+		session := s.create(t, `{}`)
+		if want := fmt.Sprintf("session-%04d", i); session.Name != want {
+			t.Errorf("got %q, want %q", session.Name, want)
+		}
+	}
+	if named := s.create(t, `{"name":"explicit"}`); named.Name != "explicit" {
+		t.Errorf("got %q", named.Name)
+	}
+}
+
+func TestReadSessionETag(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"polled"}`)
+	s.write(t, session.Id, "once")
+	path := "/read-session?id=" + session.Id.String()
+
+	res, _ := s.get(t, path)
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if res, read := s.get(t, path, "If-None-Match", etag); res.StatusCode != http.StatusNotModified || read != "" {
+		t.Errorf("unchanged: got %d %q", res.StatusCode, read)
+	}
+
+	s.write(t, session.Id, "twice")
+	if res, _ := s.get(t, path, "If-None-Match", etag); res.StatusCode != http.StatusOK || res.Header.Get("ETag") == etag {
+		t.Errorf("changed: got %d with ETag %s", res.StatusCode, res.Header.Get("ETag"))
+	}
+}
+
+func TestDebugSessions(t *testing.T) {
+	if res, _ := startServer(t).get(t, "/debug/sessions"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("without -debug: got %d", res.StatusCode)
+	}
+
+	s := startServer(t, "-debug", "-no-sync")
+	session := s.create(t, `{"name":"inspected"}`)
+	s.write(t, session.Id, "hello")
+	closed := s.create(t, `{"name":"inspected"}`)
+	s.close(t, closed.Id)
+
+	var state DebugState
+	_, read := s.get(t, "/debug/sessions")
+	decode(t, read, &state)
+	if len(state.Sessions) != 1 || len(state.ClosedSessions) != 1 {
+		t.Fatalf("got %s", read)
+	}
+	open := state.Sessions[0]
+	if open.Id != session.Id || open.Seq != 1 || open.Lines != 1 || !open.Unsynced || open.LastActivity.IsZero() {
+		t.Errorf("got %+v", open)
+	}
+	if state.NameCounts["inspected"] != 1 || state.ClosedSessions[0].Id != closed.Id {
+		t.Errorf("got %s", read)
+	}
+}
+
+func TestReadSessionDownload(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"nightly build"}`)
+	s.write(t, session.Id, "done")
+
+	res, _ := s.get(t, "/read-session?download=true&id="+session.Id.String())
+	if got := res.Header.Get("Content-Disposition"); got != `attachment; filename="nightly_build.log"` {
+		t.Errorf("got %q", got)
+	}
+	if res, _ := s.get(t, "/read-session?id="+session.Id.String()); res.Header.Get("Content-Disposition") != "" {
+		t.Error("disposition set without download")
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"build-1.2_x": "build-1.2_x",
+		`a "b"/c`:     "a__b__c",
+		"..":          "session",
+		"":            "session",
+	} {
+		if got := SanitizeFilename(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestListChildren(t *testing.T) {
+	s := startServer(t, "-cascade-close")
+	parent := s.create(t, `{"name":"job"}`)
+	children := map[string]bool{}
+	for _, name := range []string{"step-1", "step-2"} {
+		child := s.create(t, fmt.Sprintf(`{"name":%q,"parent_id":%q}`, name, parent.Id.String()))
+		children[child.Id.String()] = true
+	}
+	unrelated := s.create(t, `{"name":"other"}`)
+
+	ids := sessionIds(s.list(t, "parent="+parent.Id.String()).Sessions)
+	if len(ids) != len(children) {
+		t.Errorf("got %v, want %v", ids, children)
+	}
+	for id := range ids {
+		if !children[id] {
+			t.Errorf("%s listed as a child", id)
+		}
+	}
+	if res, read := s.post(t, "/create-session", fmt.Sprintf(`{"name":"orphan","parent_id":%q}`, uuid.NewString())); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown parent: got %d %s", res.StatusCode, read)
+	}
+
+	s.close(t, parent.Id)
+	if ids := sessionIds(s.list(t, "").Sessions); len(ids) != 1 || !ids[unrelated.Id.String()] {
+		t.Errorf("after cascading close: got %v", ids)
+	}
+}
+
+func TestCloseByTagReportsCascadedSessions(t *testing.T) {
+	s := startServer(t, "-cascade-close")
+	parent := s.create(t, `{"name":"job","tags":{"team":"core"}}`)
+	child := s.create(t, fmt.Sprintf(`{"name":"step","parent_id":%q}`, parent.Id))
+	grandchild := s.create(t, fmt.Sprintf(`{"name":"substep","parent_id":%q}`, child.Id))
+	tagged := s.create(t, fmt.Sprintf(`{"name":"tagged step","parent_id":%q,"tags":{"team":"core"}}`, parent.Id))
+	unrelated := s.create(t, `{"name":"other"}`)
+
+	res, read := s.post(t, "/close-by-tag", `{"tag":"team=core"}`)
+	var closed CloseByTagResponse
+	decode(t, read, &closed)
+	want := sessionIds([]Session{parent, child, grandchild, tagged})
+	got := map[string]bool{}
+	for _, id := range closed.Ids {
+		got[id.String()] = true
+	}
+	if res.StatusCode != http.StatusOK || closed.Count != len(want) || len(closed.Ids) != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %d %s, want ids %v", res.StatusCode, read, want)
+	}
+	if ids := sessionIds(s.list(t, "").Sessions); len(ids) != 1 || !ids[unrelated.Id.String()] {
+		t.Errorf("left open %v", ids)
+	}
+}
+
+func TestWriteAfterCloseIsGone(t *testing.T) {
+	s := startServer(t, "-gone-window", "200ms")
+	session := s.create(t, `{"name":"closing"}`)
+	s.close(t, session.Id)
+
+	write := func() int {
+		res, _ := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"late"}`, session.Id.String()))
+		return res.StatusCode
+	}
+	if status := write(); status != http.StatusGone {
+		t.Errorf("just closed: got %d", status)
+	}
+	eventually(t, 5*time.Second, func() bool { return write() == http.StatusBadRequest })
+	if _, err := os.Stat(s.path(session)); !os.IsNotExist(err) {
+		t.Errorf("late write created a file: %v", err)
+	}
+}
+
+func TestExpandName(t *testing.T) {
+	id := uuid.MustParse("0123abcd-0000-0000-0000-000000000000")
+	created := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	if got := ExpandName("build-{seq}-{date}-{uuid8}-{other}", 7, created, id); got != "build-7-2026-10-14-0123abcd-{other}" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTemplatedNamesSequence(t *testing.T) {
+	s := startServer(t)
+	first := s.create(t, `{"name":"build-{seq}-{date}"}`)
+	second := s.create(t, `{"name":"build-{seq}-{date}"}`)
+	other := s.create(t, `{"name":"deploy-{seq}"}`)
+
+	today := strings.SplitN(first.CreationTime, "T", 2)[0]
+	if first.Name != "build-1-"+today || second.Name != "build-2-"+today {
+		t.Errorf("got %q and %q", first.Name, second.Name)
+	}
+	if other.Name != "deploy-1" {
+		t.Errorf("separate prefix: got %q", other.Name)
+	}
+	if res, read := s.post(t, "/create-session", `{"name":"{date}/../x"}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsafe expansion: got %d %s", res.StatusCode, read)
+	}
+}
+
+func TestReadSessions(t *testing.T) {
+	s := startServer(t)
+	first := s.create(t, `{"name":"first"}`)
+	second := s.create(t, `{"name":"second"}`)
+	s.write(t, first.Id, `one "quoted"`)
+	s.write(t, second.Id, "two\nlines")
+	unknown := uuid.NewString()
+
+	res, read := s.get(t, fmt.Sprintf("/read-sessions?id=%s&id=%s&id=%s", first.Id, second.Id, unknown))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var contents map[string]struct {
+		Content string `json:"content"`
+		Error   string `json:"error"`
+	}
+	decode(t, read, &contents)
+	if !strings.HasSuffix(contents[first.Id.String()].Content, "Log: one \"quoted\"\n") {
+		t.Errorf("first: got %+v", contents[first.Id.String()])
+	}
+	if !strings.HasSuffix(contents[second.Id.String()].Content, "Log: two\nlines\n") {
+		t.Errorf("second: got %+v", contents[second.Id.String()])
+	}
+	if contents[unknown].Error == "" {
+		t.Errorf("unknown: got %+v", contents[unknown])
+	}
+}
+
+func TestNoTimestamp(t *testing.T) {
+	s := startServer(t, "-no-timestamp")
+	session := s.create(t, `{"name":"raw"}`)
+	s.write(t, session.Id, "2001-02-03 own timestamp")
+	s.write(t, session.Id, "second")
+
+	if lines := readLines(t, s.path(session)); len(lines) != 2 || lines[0] != "2001-02-03 own timestamp" || lines[1] != "second" {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"leveled","min_level":"warn"}`)
+	for _, level := range []string{"debug", "error", "info"} {
+		res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"%s line","level":%q}`, session.Id.String(), level, level))
+		var response WriteSessionResponse
+		decode(t, read, &response)
+		if res.StatusCode != http.StatusOK || response.Skipped != (level != "error") {
+			t.Errorf("%s: got %d %s", level, res.StatusCode, read)
+		}
+	}
+
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: error line level=error") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestLevelRank(t *testing.T) {
+	warn, _ := LevelRank("WARNING")
+	debug, _ := LevelRank("debug")
+	errorRank, _ := LevelRank("Error")
+	if !(debug < warn && warn < errorRank) {
+		t.Errorf("got debug %d, warn %d, error %d", debug, warn, errorRank)
+	}
+	if _, ok := LevelRank("loud"); ok {
+		t.Error("unknown level ranked")
+	}
+}
+
+func TestWritePlainText(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"piped"}`)
+	res, read := s.post(t, "/write-session?id="+session.Id.String(), `{"not":"json"} as is`, "Content-Type", "text/plain")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+
+	if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasSuffix(lines[0], `Log: {"not":"json"} as is`) {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestLeaseExpiryAndRenewal(t *testing.T) {
+	s := startServer(t, "-lease", "300ms")
+	_, read := s.post(t, "/create-session", `{"name":"leased"}`)
+	var created CreatedSession
+	decode(t, read, &created)
+	if created.LeaseToken == "" || created.LeaseExpiry == nil {
+		t.Fatalf("no lease in %s", read)
+	}
+	write := func(token string) int {
+		res, _ := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"x","lease_token":%q}`, created.Id.String(), token))
+		return res.StatusCode
+	}
+	if status := write(created.LeaseToken); status != http.StatusOK {
+		t.Errorf("within the lease: got %d", status)
+	}
+	if status := write("someone-else"); status != http.StatusForbidden {
+		t.Errorf("wrong token: got %d", status)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if status := write(created.LeaseToken); status != http.StatusConflict {
+		t.Errorf("after expiry: got %d", status)
+	}
+	res, read := s.post(t, "/renew-session", fmt.Sprintf(`{"id":%q,"lease_token":%q}`, created.Id.String(), created.LeaseToken))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("renew: got %d %s", res.StatusCode, read)
+	}
+	if status := write(created.LeaseToken); status != http.StatusOK {
+		t.Errorf("after renewal: got %d", status)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	s := startServer(t)
+	created := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		created[s.create(t, fmt.Sprintf(`{"name":"page-%d"}`, i)).Id.String()] = true
+	}
+
+	seen := map[string]bool{}
+	var sizes []int
+	for cursor := ""; ; {
+		page := s.list(t, "limit=2&cursor="+cursor)
+		sizes = append(sizes, len(page.Sessions))
+		for id := range sessionIds(page.Sessions) {
+			if seen[id] {
+				t.Errorf("%s listed twice", id)
+			}
+			seen[id] = true
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	if fmt.Sprint(sizes) != "[2 2 1]" || len(seen) != len(created) {
+		t.Errorf("got pages of %v covering %d sessions", sizes, len(seen))
+	}
+}
+
+// Returns a write failing with each of errs in turn, then succeeding, and a count of its calls.
+func failingWrite(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestRetryTransient(t *testing.T) {
+	write, calls := failingWrite(syscall.EINTR, syscall.EAGAIN)
+	if err := RetryTransient(2, time.Millisecond, write); err != nil || *calls != 3 {
+		t.Errorf("two transient failures: got %v after %d calls", err, *calls)
+	}
+
+	write, calls = failingWrite(syscall.EINTR, syscall.EINTR, syscall.EINTR)
+	if err := RetryTransient(2, time.Millisecond, write); !errors.Is(err, syscall.EINTR) || *calls != 3 {
+		t.Errorf("retries exhausted: got %v after %d calls", err, *calls)
+	}
+
+	write, calls = failingWrite(syscall.ENOSPC)
+	if err := RetryTransient(2, time.Millisecond, write); !errors.Is(err, syscall.ENOSPC) || *calls != 1 {
+		t.Errorf("permanent failure: got %v after %d calls", err, *calls)
+	}
+}
+
+func TestEphemeralSession(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"console","ephemeral":true}`)
+	if session.Filepath != "" || !session.Ephemeral {
+		t.Fatalf("got %+v", session)
+	}
+	s.write(t, session.Id, "on screen")
+
+	eventually(t, 5*time.Second, func() bool {
+		return strings.Contains(s.stdout.String(), fmt.Sprintf("[console %s] ", session.Id.String()[:8]))
+	})
+	if !strings.Contains(s.stdout.String(), "Log: on screen\n") {
+		t.Errorf("got %s", s.stdout.String())
+	}
+	if names := listDir(t, s.Dir); len(names) != 0 {
+		t.Errorf("created %v", names)
+	}
+	if res, _ := s.get(t, "/read-session?id="+session.Id.String()); res.StatusCode != http.StatusConflict {
+		t.Errorf("read: got %d", res.StatusCode)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, keepalive := range []bool{true, false} {
+		s := startServer(t, fmt.Sprintf("-keepalive=%v", keepalive))
+		session := s.create(t, `{"name":"reused"}`)
+		client := &http.Client{Transport: &http.Transport{}}
+		var reused []bool
+		for i := 0; i < 2; i++ {
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) }}
+			body := fmt.Sprintf(`{"id":%q,"content":"line %d"}`, session.Id.String(), i)
+			req, _ := http.NewRequest("POST", s.URL+"/write-session", strings.NewReader(body))
+			res, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		if fmt.Sprint(reused) != fmt.Sprintf("[false %v]", keepalive) {
+			t.Errorf("keepalive %v: connections reused %v", keepalive, reused)
+		}
+	}
+}
+
+func TestMaxBackups(t *testing.T) {
+	s := startServer(t, "-max-backups", "2")
+	session := s.create(t, `{"name":"capped"}`)
+	var rotated []string
+	for i := 1; i <= 4; i++ {
+		s.write(t, session.Id, fmt.Sprintf("line %d", i))
+		res, read := s.post(t, "/rotate-session", fmt.Sprintf(`{"id":%q}`, session.Id.String()))
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("rotation %d: got %d %s", i, res.StatusCode, read)
+		}
+		var response RotateSessionResponse
+		decode(t, read, &response)
+		rotated = append(rotated, filepath.Base(response.RotatedPath))
+	}
+
+	names := listDir(t, s.Dir)
+	if len(names) != 3 {
+		t.Fatalf("got %v", names)
+	}
+	for i, name := range rotated {
+		_, err := os.Stat(filepath.Join(s.Dir, name))
+		if kept := i >= 2; kept != (err == nil) {
+			t.Errorf("backup %d %s: kept %v", i+1, name, err == nil)
+		}
+	}
+	if lines := readLines(t, filepath.Join(s.Dir, rotated[3])); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: line 4") {
+		t.Errorf("newest backup: got %q", lines)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "build-2026-10-14T00:00:00Z-0123abcd")
+	os.WriteFile(path, nil, 0644)
+	os.WriteFile(path+".notes", nil, 0644)
+	for i, suffix := range []string{".2026-10-11", ".2026-10-12.gz", ".2026-10-13"} {
+		os.WriteFile(path+suffix, nil, 0644)
+		modTime := time.Date(2026, 10, 11+i, 0, 0, 0, 0, time.UTC)
+		os.Chtimes(path+suffix, modTime, modTime)
+	}
+
+	deleted, err := PruneBackups(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("deleted %v", deleted)
+	}
+	if got := strings.Join(listDir(t, dir), ","); got != "build-2026-10-14T00:00:00Z-0123abcd,build-2026-10-14T00:00:00Z-0123abcd.2026-10-13,build-2026-10-14T00:00:00Z-0123abcd.notes" {
+		t.Errorf("left %s", got)
+	}
+}
+
+func TestRotateDuringWrites(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"shipped"}`)
+	s.write(t, session.Id, "line 0")
+
+	const writes = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= writes; i++ {
+			s.write(t, session.Id, fmt.Sprintf("line %d", i))
+		}
+	}()
+	files := []string{}
+	for rotating := true; rotating; {
+		select {
+		case <-done:
+			rotating = false
+		default:
+			res, read := s.post(t, "/rotate-session", fmt.Sprintf(`{"id":%q}`, session.Id.String()))
+			if res.StatusCode == http.StatusOK {
+				var response RotateSessionResponse
+				decode(t, read, &response)
+				files = append(files, filepath.Join(s.Dir, filepath.Base(response.RotatedPath)))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	files = append(files, s.path(session))
+	if len(files) < 3 {
+		t.Fatalf("only rotated %d times", len(files)-1)
+	}
+
+	var content []string
+	for _, path := range files {
+		if data, _ := os.ReadFile(path); len(data) > 0 {
+			content = append(content, readLines(t, path)...)
+		}
+	}
+	if len(content) != writes+1 {
+		t.Fatalf("got %d lines, want %d", len(content), writes+1)
+	}
+	for i, line := range content {
+		if !strings.HasSuffix(line, fmt.Sprintf("[%d] Log: line %d", i+1, i)) {
+			t.Fatalf("line %d is %q", i, line)
+		}
+	}
+}
+
+func TestLogDirsRoundRobin(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	s := startServer(t, "-log-dirs", first+","+second)
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		session := s.create(t, fmt.Sprintf(`{"name":"spread-%d"}`, i))
+		s.write(t, session.Id, "placed")
+		counts[filepath.Dir(session.Filepath)]++
+	}
+	if counts[first] != 2 || counts[second] != 2 {
+		t.Errorf("got %v", counts)
+	}
+
+	missing := filepath.Join(first, "missing")
+	if output := startFailing(t, "-log-dirs", first+","+missing); !strings.Contains(output, missing) {
+		t.Errorf("missing dir: got %s", output)
+	}
+}
+
+func TestHideFilepaths(t *testing.T) {
+	s := startServer(t, "-hide-filepaths")
+	session := s.create(t, `{"name":"hidden"}`)
+	if session.Filepath != Redacted {
+		t.Errorf("create: got %q", session.Filepath)
+	}
+	s.write(t, session.Id, "still written")
+
+	list := s.list(t, "")
+	if len(list.Sessions) != 1 || list.Sessions[0].Filepath != Redacted {
+		t.Errorf("list: got %+v", list.Sessions)
+	}
+	_, read := s.get(t, "/session-stat?id="+session.Id.String())
+	if strings.Contains(read, s.Dir) {
+		t.Errorf("stat: got %s", read)
+	}
+	if names := listDir(t, s.Dir); len(names) != 1 || !strings.HasPrefix(names[0], "hidden-") {
+		t.Errorf("files %v", names)
+	}
+}
+
+func TestHideFilepathsInMessages(t *testing.T) {
+	target := t.TempDir()
+	s := startServer(t, "-hide-filepaths", "-allowed-dirs", target)
+	session := s.create(t, `{"name":"hidden"}`)
+	s.write(t, session.Id, "before rotating")
+	name := listDir(t, s.Dir)[0]
+	shown := func(what string, read string) {
+		t.Helper()
+		if strings.Contains(read, s.Dir) || strings.Contains(read, target) {
+			t.Errorf("%s: got %s", what, read)
+		}
+	}
+
+	res, read := s.post(t, "/rotate-session", fmt.Sprintf(`{"id":%q}`, session.Id.String()))
+	var rotated RotateSessionResponse
+	decode(t, read, &rotated)
+	if res.StatusCode != http.StatusOK || rotated.RotatedPath != Redacted {
+		t.Errorf("rotate: got %d %s", res.StatusCode, read)
+	}
+
+	// A directory where the file should be makes the next write fail
+	path := filepath.Join(s.Dir, name)
+	os.Remove(path)
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	res, read = s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"fails"}`, session.Id.String()))
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("write: got %d %s", res.StatusCode, read)
+	}
+	shown("write", read)
+	_, read = s.get(t, "/session-errors?id="+session.Id.String())
+	if !strings.Contains(read, Redacted) {
+		t.Errorf("session-errors: got %s", read)
+	}
+	shown("session-errors", read)
+	os.Remove(path)
+
+	os.WriteFile(filepath.Join(target, name), nil, 0644)
+	res, read = s.post(t, "/move-session", fmt.Sprintf(`{"id":%q,"dir":%q}`, session.Id.String(), target))
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("move onto a file: got %d %s", res.StatusCode, read)
+	}
+	shown("move onto a file", read)
+	os.Remove(filepath.Join(target, name))
+	res, read = s.post(t, "/move-session", fmt.Sprintf(`{"id":%q,"dir":%q}`, session.Id.String(), target))
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("move: got %d %s", res.StatusCode, read)
+	}
+	shown("move", read)
+}
+
+func TestPauseAndResume(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		s := startServer(t, fmt.Sprintf("-drop-paused-writes=%v", drop))
+		session := s.create(t, `{"name":"noisy"}`)
+		toggle := func(path string) {
+			if res, read := s.post(t, path, fmt.Sprintf(`{"id":%q}`, session.Id.String())); res.StatusCode != http.StatusOK {
+				t.Fatalf("%s: got %d %s", path, res.StatusCode, read)
+			}
+		}
+
+		toggle("/pause-session")
+		res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"muted"}`, session.Id.String()))
+		if want := map[bool]int{false: http.StatusLocked, true: http.StatusOK}[drop]; res.StatusCode != want {
+			t.Errorf("drop %v: paused write got %d %s", drop, res.StatusCode, read)
+		}
+		toggle("/resume-session")
+		s.write(t, session.Id, "heard")
+
+		if lines := readLines(t, s.path(session)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: heard") {
+			t.Errorf("drop %v: got %q", drop, lines)
+		}
+	}
+}
+
+func TestCloseWithFinalContent(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"footer"}`)
+	s.write(t, session.Id, "work")
+	res, read := s.post(t, "/close-session", fmt.Sprintf(`{"id":%q,"final_content":"exit code 0"}`, session.Id.String()))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+
+	lines := readLines(t, s.path(session))
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], "[2] Log: exit code 0") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestCloseFinalContentChecked(t *testing.T) {
+	s := startServer(t, "-lease", "1h", "-max-line-length", "10", "-on-oversize", "reject")
+	var created CreatedSession
+	_, read := s.post(t, "/create-session", `{"name":"leased"}`)
+	decode(t, read, &created)
+	closeWith := func(body string) (int, string) {
+		res, read := s.post(t, "/close-session", fmt.Sprintf(`{"id":%q,%s}`, created.Id.String(), body))
+		return res.StatusCode, read
+	}
+
+	for _, body := range []string{
+		`"final_content":"done"`,
+		fmt.Sprintf(`"final_content":"done","lease_token":"%s"`, uuid.NewString()),
+		fmt.Sprintf(`"final_content":%q,"lease_token":%q`, strings.Repeat("x", 60), created.LeaseToken),
+	} {
+		if status, read := closeWith(body); status == http.StatusOK || !strings.Contains(read, "session left open") {
+			t.Errorf("%s: got %d %s", body, status, read)
+		}
+	}
+	if list := s.list(t, ""); len(list.Sessions) != 1 {
+		t.Fatalf("closed after a refused final write: %+v", list.Sessions)
+	}
+	if _, err := os.Stat(s.path(created.Session)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("refused final content was written: %v", err)
+	}
+
+	if status, read := closeWith(fmt.Sprintf(`"final_content":"done","lease_token":%q`, created.LeaseToken)); status != http.StatusOK {
+		t.Fatalf("with the lease: got %d %s", status, read)
+	}
+	if lines := readLines(t, s.path(created.Session)); len(lines) != 1 || !strings.HasSuffix(lines[0], "Log: done") {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestSessionSince(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"polled"}`)
+	for i := 1; i <= 5; i++ {
+		s.write(t, session.Id, fmt.Sprintf("line %d", i))
+	}
+
+	_, read := s.get(t, "/session-since?lines=true&seq=2&id="+session.Id.String())
+	var since SessionSince
+	decode(t, read, &since)
+	if since.Count != 3 || len(since.Lines) != 3 || !strings.HasSuffix(since.Lines[0], "[3] Log: line 3") {
+		t.Errorf("got %+v", since)
+	}
+	_, read = s.get(t, "/session-since?seq=5&id="+session.Id.String())
+	decode(t, read, &since)
+	if since.Count != 0 {
+		t.Errorf("up to date: got %+v", since)
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	lenient := startServer(t)
+	if res, read := lenient.post(t, "/create-session", `{"name":"typo","naem":"x"}`); res.StatusCode != http.StatusOK {
+		t.Errorf("lenient: got %d %s", res.StatusCode, read)
+	}
+
+	strict := startServer(t, "-strict-json")
+	res, read := strict.post(t, "/create-session", `{"name":"typo","naem":"x"}`)
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(read, "naem") {
+		t.Errorf("strict: got %d %s", res.StatusCode, read)
+	}
+	strict.create(t, `{"name":"fine"}`)
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	content := "a\r\nb\rc\nd"
+	for style, want := range map[string]string{
+		"":           content,
+		NewlinesLF:   "a\nb\nc\nd",
+		NewlinesCRLF: "a\r\nb\r\nc\r\nd",
+	} {
+		if got := NormalizeNewlines(content, style); got != want {
+			t.Errorf("%q: got %q, want %q", style, got, want)
+		}
+	}
+}
+
+func TestWriteNormalizesNewlines(t *testing.T) {
+	s := startServer(t, "-normalize-newlines", NewlinesLF)
+	session := s.create(t, `{"name":"windows"}`)
+	s.write(t, session.Id, "first\r\nsecond")
+
+	data, err := os.ReadFile(s.path(session))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "\r") || !strings.HasSuffix(string(data), "Log: first\nsecond\n") {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestCreatePlainTextId(t *testing.T) {
+	s := startServer(t)
+	res, read := s.post(t, "/create-session", `{"name":"scripted"}`, "Accept", "text/plain")
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("got %d %s %s", res.StatusCode, res.Header.Get("Content-Type"), read)
+	}
+	id, err := uuid.Parse(strings.TrimSpace(read))
+	if err != nil {
+		t.Fatalf("got %q: %s", read, err.Error())
+	}
+	s.write(t, id, "by id")
+}
+
+func TestCreateIfNotExists(t *testing.T) {
+	s := startServer(t)
+	body := `{"name":"singleton","create_if_not_exists":true}`
+	res, read := s.post(t, "/create-session", body)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("first: got %d %s", res.StatusCode, read)
+	}
+	var created Session
+	decode(t, read, &created)
+
+	res, read = s.post(t, "/create-session", body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("second: got %d %s", res.StatusCode, read)
+	}
+	var existing Session
+	decode(t, read, &existing)
+	if existing.Id != created.Id {
+		t.Errorf("got %s, want %s", existing.Id, created.Id)
+	}
+	if list := s.list(t, ""); len(list.Sessions) != 1 {
+		t.Errorf("got %d sessions", len(list.Sessions))
+	}
+}
+
+func TestReadSessionFrom(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"searched"}`)
+	for _, content := range []string{"starting", "working", "ERROR: disk", "retrying", "ERROR: again"} {
+		s.write(t, session.Id, content)
+	}
+
+	res, read := s.get(t, "/read-session?from="+url.QueryEscape("ERROR: [a-z]+$")+"&id="+session.Id.String())
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	lines := strings.Split(strings.TrimSuffix(read, "\n"), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "[3] Log: ERROR: disk") {
+		t.Errorf("got %q", read)
+	}
+	if res, _ := s.get(t, "/read-session?from=%28&id="+session.Id.String()); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid pattern: got %d", res.StatusCode)
+	}
+}
+
+func TestUpdateTags(t *testing.T) {
+	s := startServer(t)
+	session := s.create(t, `{"name":"tagged","tags":{"team":"infra","stage":"build"}}`)
+	update := func(mode string, tags string) (int, string) {
+		res, read := s.do(t, "PATCH", "/update-tags?mode="+mode, fmt.Sprintf(`{"id":%q,"tags":%s}`, session.Id.String(), tags))
+		return res.StatusCode, read
+	}
+	listed := func() map[string]string {
+		return s.list(t, "").Sessions[0].Tags
+	}
+
+	if status, read := update("merge", `{"owner":"ci","stage":null}`); status != http.StatusOK {
+		t.Fatalf("merge: got %d %s", status, read)
+	}
+	if tags := listed(); fmt.Sprint(tags) != "map[owner:ci team:infra]" {
+		t.Errorf("after merge: got %v", tags)
+	}
+	if status, read := update("replace", `{"only":"this"}`); status != http.StatusOK {
+		t.Fatalf("replace: got %d %s", status, read)
+	}
+	if tags := listed(); fmt.Sprint(tags) != "map[only:this]" {
+		t.Errorf("after replace: got %v", tags)
+	}
+
+	for mode, tags := range map[string]string{"replace": `{"gone":null}`, "merge": `{"bad key!":"x"}`, "upsert": `{"a":"b"}`} {
+		if status, read := update(mode, tags); status != http.StatusBadRequest {
+			t.Errorf("%s %s: got %d %s", mode, tags, status, read)
+		}
+	}
+}
+
+func TestDedupeSkipsIdenticalConsecutiveWrites(t *testing.T) {
+	s := startServer(t, "-dedupe-window", "1m")
+	session := s.create(t, `{"name":"deduped","dedupe":true}`)
+	if first := s.write(t, session.Id, "same"); first.Skipped {
+		t.Fatal("first write skipped")
+	}
+	if second := s.write(t, session.Id, "same"); !second.Skipped {
+		t.Error("identical consecutive write was not skipped")
+	}
+	s.write(t, session.Id, "other")
+	if third := s.write(t, session.Id, "same"); third.Skipped {
+		t.Error("write after a different one was skipped")
+	}
+
+	if lines := readLines(t, s.path(session)); len(lines) != 3 {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestReadLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	long := strings.Repeat("x", 10000)
+	for content, want := range map[string]string{"": "", "only\n": "only", "first\nsecond\n": "second", "first\n" + long + "\n": long, "no newline": "no newline"} {
+		os.WriteFile(path, []byte(content), 0644)
+		if line, err := ReadLastLine(path); err != nil || line != want {
+			t.Errorf("%.20q: got %.20q, %v", content, line, err)
+		}
+	}
+}
+
+func TestListSessionsPreview(t *testing.T) {
+	s := startServer(t)
+	first := s.create(t, `{"name":"first"}`)
+	second := s.create(t, `{"name":"second"}`)
+	s.write(t, first.Id, "first early")
+	s.write(t, first.Id, "first latest")
+	s.write(t, second.Id, "second latest")
+
+	previews := s.list(t, "preview=true").Previews
+	for id, want := range map[uuid.UUID]string{first.Id: "Log: first latest", second.Id: "Log: second latest"} {
+		if preview := previews[id]; !strings.HasSuffix(preview, want) {
+			t.Errorf("%s: got %q, want suffix %q", id, preview, want)
+		}
+	}
+	if previews := s.list(t, "").Previews; previews != nil {
+		t.Errorf("without preview: got %v", previews)
+	}
+}
+
+func TestEmptyWrites(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		s := startServer(t, fmt.Sprintf("-allow-empty-writes=%v", allow))
+		session := s.create(t, `{"name":"empty"}`)
+		res, read := s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":""}`, session.Id.String()))
+		if allow {
+			var response WriteSessionResponse
+			decode(t, read, &response)
+			if res.StatusCode != http.StatusOK || !response.Skipped {
+				t.Errorf("allowed: got %d %s", res.StatusCode, read)
+			}
+		} else if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("rejected: got %d %s", res.StatusCode, read)
+		}
+		if data, err := os.ReadFile(s.path(session)); err == nil && len(data) > 0 {
+			t.Errorf("allow %v: wrote %q", allow, data)
+		}
+
+		// Fields alone are still written
+		res, read = s.post(t, "/write-session", fmt.Sprintf(`{"id":%q,"content":"","fields":{"k":"v"}}`, session.Id.String()))
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("allow %v, fields only: got %d %s", allow, res.StatusCode, read)
+		}
+	}
+}
+
+func TestRecentSessionKeepsLastLines(t *testing.T) {
+	s := startServer(t, "-memory-tail", "10")
+	session := s.create(t, `{"name":"recent"}`)
+	for i := 1; i <= 15; i++ {
+		s.write(t, session.Id, fmt.Sprintf("line %d", i))
+	}
+
+	res, read := s.get(t, "/recent-session?id="+session.Id.String())
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %s", res.StatusCode, read)
+	}
+	var recent RecentSession
+	decode(t, read, &recent)
+	if len(recent.Lines) != 10 {
+		t.Fatalf("got %q", recent.Lines)
+	}
+	file := readLines(t, s.path(session))
+	for i, line := range recent.Lines {
+		if want := fmt.Sprintf("Log: line %d", i+6); !strings.HasSuffix(line, want) || line != file[i+5] {
+			t.Errorf("line %d: got %q, want suffix %q as in the file", i, line, want)
+		}
+	}
+
+	s.close(t, session.Id)
+	if res, _ := s.get(t, "/recent-session?id="+session.Id.String()); res.StatusCode != http.StatusNotFound {
+		t.Errorf("closed: got %d", res.StatusCode)
+	}
+	if res, _ := startServer(t).get(t, "/recent-session?id="+session.Id.String()); res.StatusCode != http.StatusNotFound {
+		t.Errorf("without -memory-tail: got %d", res.StatusCode)
+	}
+}
+
+func TestStdoutMode(t *testing.T) {
+	s := startServer(t, "-stdout-mode")
+	first := s.create(t, `{"name":"web"}`)
+	second := s.create(t, `{"name":"worker","ephemeral":false}`)
+	for _, session := range []Session{first, second} {
+		if session.Filepath != "" || !session.Ephemeral {
+			t.Errorf("got %+v", session)
+		}
+		s.write(t, session.Id, "to stdout from "+session.Name)
+	}
+
+	eventually(t, 5*time.Second, func() bool {
+		stdout := s.stdout.String()
+		return strings.Contains(stdout, fmt.Sprintf("[web %s] ", first.Id.String()[:8])) && strings.Contains(stdout, fmt.Sprintf("[worker %s] ", second.Id.String()[:8]))
+	})
+	for _, want := range []string{"Log: to stdout from web\n", "Log: to stdout from worker\n"} {
+		if !strings.Contains(s.stdout.String(), want) {
+			t.Errorf("stdout lacks %q", want)
+		}
+	}
+	if names := listDir(t, s.Dir); len(names) != 0 {
+		t.Errorf("created %v", names)
+	}
+
+	if list := s.list(t, ""); len(list.Sessions) != 2 {
+		t.Errorf("listed %+v", list.Sessions)
+	}
+	s.close(t, first.Id)
+	if ids := sessionIds(s.list(t, "").Sessions); len(ids) != 1 || !ids[second.Id.String()] {
+		t.Errorf("after close: got %v", ids)
+	}
+	if names := listDir(t, s.Dir); len(names) != 0 {
+		t.Errorf("close created %v", names)
+	}
+}
+
+func TestStdoutModeRejectsFileFlags(t *testing.T) {
+	if output := startFailing(t, "-stdout-mode", "-shard-size", "100"); !strings.Contains(output, "-stdout-mode writes no files") {
+		t.Errorf("got %s", output)
+	}
+}
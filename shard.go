@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Matches the names of a sharded session's files: 00000, 00001, ...
+var ShardNamePattern = regexp.MustCompile(`^\d{5,}$`)
+
+// Returns the path of a session's shard with the given index.
+func ShardPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d", index))
+}
+
+// Lists the shards in dir, in the order they were written.
+func ShardPaths(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if !entry.IsDir() && ShardNamePattern.MatchString(entry.Name()) {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	// Zero padded, so names sort in order until the padding runs out
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) < len(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+
+	return paths, nil
+}
+
+// Returns the latest modification time of the files at paths, ignoring any that can't be read.
+func NewestModTime(paths []string) time.Time {
+	var newest time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest
+}
+
+// Returns the total size of the shards in dir and when the newest was last modified. Fails with fs.ErrNotExist if
+// nothing has been written yet.
+func StatShards(dir string) (int64, time.Time, error) {
+	paths, err := ShardPaths(dir)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if len(paths) == 0 {
+		return 0, time.Time{}, fs.ErrNotExist
+	}
+	var size int64
+	var newest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		size += info.Size()
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return size, newest, nil
+}
+
+// Reads a sharded session's files one after the other, closing all of them.
+type ShardReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (s ShardReader) Close() error {
+	var err error
+	for _, file := range s.files {
+		if closeErr := file.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Opens the shards in dir as one stream. Fails with fs.ErrNotExist if nothing has been written yet.
+func OpenShards(dir string) (io.ReadCloser, error) {
+	paths, err := ShardPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	shards := ShardReader{}
+	readers := make([]io.Reader, 0, len(paths))
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			shards.Close()
+			return nil, err
+		}
+		shards.files = append(shards.files, file)
+		readers = append(readers, file)
+	}
+	shards.Reader = io.MultiReader(readers...)
+
+	return shards, nil
+}
+
+// Opens a session's log for reading, across all of its shards if it has them.
+func OpenSessionLog(session Session) (io.ReadCloser, error) {
+	if session.Sharded {
+		return OpenShards(filepath.Dir(session.Filepath))
+	}
+
+	return OpenLogFile(session.Filepath)
+}
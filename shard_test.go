@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShardPathsOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"00010", "00002", "100000", "00001", "notes.txt"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	paths, err := ShardPaths(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	if got := strings.Join(names, ","); got != "00001,00002,00010,100000" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestOpenShardsReadsContiguously(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(ShardPath(dir, 0), []byte("one\n"), 0644)
+	os.WriteFile(ShardPath(dir, 1), []byte("two\n"), 0644)
+	reader, err := OpenShards(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	read, _ := io.ReadAll(reader)
+	if string(read) != "one\ntwo\n" {
+		t.Errorf("got %q", read)
+	}
+
+	if _, err := OpenShards(t.TempDir()); !os.IsNotExist(err) {
+		t.Errorf("empty dir: got %v", err)
+	}
+}
+
+func TestShardedSessionReadsBackAllShards(t *testing.T) {
+	s := startServer(t, "-shard-size", "60")
+	session := s.create(t, `{"name":"sharded"}`)
+	for _, content := range []string{"line 1", "line 2", "line 3"} {
+		s.write(t, session.Id, content)
+	}
+
+	shards, err := ShardPaths(filepath.Join(s.Dir, filepath.Base(filepath.Dir(session.Filepath))))
+	if err != nil || len(shards) < 2 {
+		t.Fatalf("got shards %v, %v", shards, err)
+	}
+	for path, read := range map[string]string{
+		"/read-session": s.read(t, session.Id),
+		"/logs":         func() string { _, read := s.get(t, "/logs"); return read }(),
+	} {
+		lines := strings.Split(strings.TrimSuffix(read, "\n"), "\n")
+		if len(lines) != 3 {
+			t.Errorf("%s: got %q", path, read)
+			continue
+		}
+		for i, line := range lines {
+			if want := "Log: line " + string(rune('1'+i)); !strings.HasSuffix(line, want) {
+				t.Errorf("%s: line %d is %q, want suffix %q", path, i+1, line, want)
+			}
+		}
+	}
+}
+
+func TestSweepOldFilesDeletesShardedSessions(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"closed-2026-10-14T00:00:00Z-0123abcd", "open-2026-10-14T00:00:00Z-4567abcd"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		for i := 0; i < 2; i++ {
+			os.WriteFile(ShardPath(filepath.Join(dir, name), i), []byte("line\n"), 0644)
+			os.Chtimes(ShardPath(filepath.Join(dir, name), i), old, old)
+		}
+	}
+
+	open := map[string]bool{filepath.Join(dir, "open-2026-10-14T00:00:00Z-4567abcd"): true}
+	deleted := SweepOldFiles(dir, time.Now().Add(-time.Minute), open)
+	if len(deleted) != 1 || filepath.Base(deleted[0]) != "closed-2026-10-14T00:00:00Z-0123abcd" {
+		t.Errorf("deleted %v", deleted)
+	}
+	if names := listDir(t, dir); len(names) != 1 || !strings.HasPrefix(names[0], "open-") {
+		t.Errorf("left %v", names)
+	}
+}
+
+func TestSessionStatSumsShards(t *testing.T) {
+	s := startServer(t, "-shard-size", "60")
+	session := s.create(t, `{"name":"sharded"}`)
+	for _, content := range []string{"line 1", "line 2", "line 3"} {
+		s.write(t, session.Id, content)
+	}
+
+	_, read := s.get(t, "/session-stat?id="+session.Id.String())
+	var stat SessionStat
+	decode(t, read, &stat)
+	shards, _ := ShardPaths(filepath.Join(s.Dir, filepath.Base(filepath.Dir(session.Filepath))))
+	if len(shards) < 2 {
+		t.Fatalf("got shards %v", shards)
+	}
+	if stat.Size != int64(stat.Bytes) || stat.Bytes == 0 {
+		t.Errorf("got size %d, bytes %d", stat.Size, stat.Bytes)
+	}
+	if newest := NewestModTime(shards); !stat.ModTime.Equal(newest) {
+		t.Errorf("got mod time %s, want %s", stat.ModTime, newest)
+	}
+}
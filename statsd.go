@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Sends counters and timers to a StatsD server over UDP. Send errors are ignored, metrics are best effort. A nil
+// *StatsD sends nothing.
+type StatsD struct {
+	conn net.Conn
+}
+
+func NewStatsD(addr string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsD{conn}, nil
+}
+
+func (s *StatsD) Count(name string, value int64) {
+	if s != nil {
+		fmt.Fprintf(s.conn, "%s:%d|c", name, value)
+	}
+}
+
+func (s *StatsD) Timing(name string, duration time.Duration) {
+	if s != nil {
+		// Fractional milliseconds, most writes take well under one
+		fmt.Fprintf(s.conn, "%s:%.3f|ms", name, float64(duration.Microseconds())/1000)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A StatsD server over UDP, recording each metric it receives.
+type fakeStatsD struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	metrics []string
+}
+
+func startFakeStatsD(t *testing.T) *fakeStatsD {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	server := &fakeStatsD{conn: conn}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.metrics = append(server.metrics, string(buf[:n]))
+			server.mu.Unlock()
+		}
+	}()
+
+	return server
+}
+
+// Returns whether a received metric matches pattern.
+func (f *fakeStatsD) received(pattern string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, metric := range f.metrics {
+		if regexp.MustCompile("^" + pattern + "$").MatchString(metric) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestStatsDCountsCreatesAndWrites(t *testing.T) {
+	statsd := startFakeStatsD(t)
+	s := startServer(t, "-statsd-addr", statsd.conn.LocalAddr().String())
+	session := s.create(t, `{"name":"counted"}`)
+	eventually(t, 5*time.Second, func() bool { return statsd.received(`session\.created:1\|c`) })
+
+	s.write(t, session.Id, "hello")
+	eventually(t, 5*time.Second, func() bool {
+		return statsd.received(`write\.succeeded:1\|c`) && statsd.received(`write\.latency:[0-9]+\.[0-9]{3}\|ms`)
+	})
+	s.close(t, session.Id)
+	eventually(t, 5*time.Second, func() bool { return statsd.received(`session\.closed:1\|c`) })
+}
+
+func TestStatsDIgnoresSendFailures(t *testing.T) {
+	// Nothing listens on a closed port, so sends fail with connection refused
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	s := startServer(t, "-statsd-addr", addr)
+	session := s.create(t, `{"name":"unheard"}`)
+	for i := 0; i < 3; i++ {
+		s.write(t, session.Id, "still written")
+	}
+	if lines := readLines(t, s.path(session)); len(lines) != 3 {
+		t.Errorf("got %q", lines)
+	}
+
+	var nilStatsD *StatsD
+	nilStatsD.Count("session.created", 1)
+	nilStatsD.Timing("write.latency", time.Millisecond)
+}
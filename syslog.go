@@ -0,0 +1,108 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+type SyslogLine struct {
+	Tag  string
+	Line string
+}
+
+// Most syslog connections kept open at once. log/syslog fixes the tag when connecting, so each session name needs its
+// own; the least recently used is closed to make room for another.
+const MaxSyslogWriters = 64
+
+// Forwards log lines to a syslog server from a background goroutine, one connection per tag.
+type SyslogForwarder struct {
+	network string
+	addr    string
+	lines   chan SyslogLine
+	writers map[string]*list.Element
+	// Tags of the open writers, most recently used first
+	recent *list.List
+}
+
+type syslogWriter struct {
+	tag    string
+	writer *syslog.Writer
+}
+
+// Fails if network isn't udp or tcp, or addr isn't a host:port. Connections are only made once lines are forwarded, so
+// the server needn't be up yet.
+func NewSyslogForwarder(network string, addr string) (*SyslogForwarder, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("-syslog-network must be udp or tcp, not %q", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("-syslog-addr: %s", err.Error())
+	}
+
+	forwarder := &SyslogForwarder{
+		network: network,
+		addr:    addr,
+		lines:   make(chan SyslogLine, 1024),
+		writers: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+	go forwarder.run()
+
+	return forwarder, nil
+}
+
+// Queues a line for forwarding. Never blocks; lines are dropped if the queue is full.
+func (f *SyslogForwarder) Forward(tag string, line string) {
+	select {
+	case f.lines <- SyslogLine{tag, strings.TrimRight(line, "\n")}:
+	default:
+		log.Printf("Syslog queue is full, dropping line for %s", tag)
+	}
+}
+
+func (f *SyslogForwarder) run() {
+	for line := range f.lines {
+		writer, err := f.writer(line.Tag)
+		if err != nil {
+			log.Printf("Could not connect to syslog at %s: %s", f.addr, err.Error())
+			continue
+		}
+
+		if err := writer.Info(line.Line); err != nil {
+			log.Printf("Could not forward line to syslog at %s: %s", f.addr, err.Error())
+			// Reconnect on the next line
+			f.close(f.writers[line.Tag])
+		}
+	}
+}
+
+// Returns the writer for tag, connecting if there isn't one open.
+func (f *SyslogForwarder) writer(tag string) (*syslog.Writer, error) {
+	if element, exists := f.writers[tag]; exists {
+		f.recent.MoveToFront(element)
+		return element.Value.(syslogWriter).writer, nil
+	}
+
+	writer, err := syslog.Dial(f.network, f.addr, syslog.LOG_INFO|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, err
+	}
+	if f.recent.Len() >= MaxSyslogWriters {
+		f.close(f.recent.Back())
+	}
+	f.writers[tag] = f.recent.PushFront(syslogWriter{tag, writer})
+
+	return writer, nil
+}
+
+func (f *SyslogForwarder) close(element *list.Element) {
+	open := f.recent.Remove(element).(syslogWriter)
+	open.writer.Close()
+	delete(f.writers, open.tag)
+}
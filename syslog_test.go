@@ -0,0 +1,96 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A syslog server over TCP, recording each message and how many connections it has seen opened and closed.
+type fakeSyslog struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []string
+	opened   int
+	closed   int
+}
+
+func startFakeSyslog(t *testing.T) *fakeSyslog {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &fakeSyslog{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.opened++
+			server.mu.Unlock()
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					server.mu.Lock()
+					server.messages = append(server.messages, scanner.Text())
+					server.mu.Unlock()
+				}
+				server.mu.Lock()
+				server.closed++
+				server.mu.Unlock()
+			}()
+		}
+	}()
+
+	return server
+}
+
+func (f *fakeSyslog) counts() (messages int, opened int, closed int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.messages), f.opened, f.closed
+}
+
+func TestWriteForwardedToSyslog(t *testing.T) {
+	syslog := startFakeSyslog(t)
+	s := startServer(t, "-syslog-network", "tcp", "-syslog-addr", syslog.listener.Addr().String())
+	session := s.create(t, `{"name":"forwarded"}`)
+	s.write(t, session.Id, "hello syslog")
+
+	eventually(t, 5*time.Second, func() bool {
+		messages, _, _ := syslog.counts()
+		return messages == 1
+	})
+	syslog.mu.Lock()
+	defer syslog.mu.Unlock()
+	if message := syslog.messages[0]; !strings.Contains(message, " forwarded[") || !strings.HasSuffix(message, "Log: hello syslog") {
+		t.Errorf("got %q", message)
+	}
+}
+
+func TestSyslogForwarderBoundsConnections(t *testing.T) {
+	syslog := startFakeSyslog(t)
+	forwarder, err := NewSyslogForwarder("tcp", syslog.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := MaxSyslogWriters + 10
+	for i := 0; i < tags; i++ {
+		forwarder.Forward(fmt.Sprintf("session-%d", i), "line\n")
+	}
+
+	eventually(t, 5*time.Second, func() bool {
+		messages, opened, closed := syslog.counts()
+		return messages == tags && opened == tags && closed == tags-MaxSyslogWriters
+	})
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+type SyslogForwarder struct{}
+
+func NewSyslogForwarder(network string, addr string) (*SyslogForwarder, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (f *SyslogForwarder) Forward(tag string, line string) {}
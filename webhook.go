@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session lifecycle event types.
+const (
+	EventCreated = "created"
+	EventClosed  = "closed"
+)
+
+type SessionEvent struct {
+	Type string    `json:"type"`
+	Id   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	Time string    `json:"time"`
+}
+
+// Delivers session events to a webhook from a background goroutine, retrying failed deliveries with backoff.
+type Webhook struct {
+	url     string
+	retries int
+	client  *http.Client
+	events  chan SessionEvent
+}
+
+func NewWebhook(url string, retries int, timeout time.Duration) *Webhook {
+	webhook := &Webhook{
+		url:     url,
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+		events:  make(chan SessionEvent, 1024),
+	}
+	go webhook.run()
+
+	return webhook
+}
+
+// Queues an event. Never blocks; events are dropped if the queue is full.
+func (h *Webhook) Notify(event SessionEvent) {
+	select {
+	case h.events <- event:
+	default:
+		log.Printf("Webhook queue is full, dropping %s event for %s", event.Type, event.Id.String())
+	}
+}
+
+func (h *Webhook) run() {
+	for event := range h.events {
+		body, _ := json.Marshal(event)
+		backoff := 100 * time.Millisecond
+		for attempt := 0; ; attempt++ {
+			err := h.deliver(body)
+			if err == nil {
+				break
+			}
+			if attempt >= h.retries {
+				log.Printf("Could not deliver %s event for %s to webhook: %s", event.Type, event.Id.String(), err.Error())
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (h *Webhook) deliver(body []byte) error {
+	response, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+
+	return nil
+}
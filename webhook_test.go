@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the events posted to it, failing the first 'failures' deliveries.
+type eventReceiver struct {
+	mu       sync.Mutex
+	failures int
+	events   []SessionEvent
+}
+
+func (e *eventReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failures > 0 {
+		e.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var event SessionEvent
+	json.NewDecoder(r.Body).Decode(&event)
+	e.events = append(e.events, event)
+}
+
+func (e *eventReceiver) received() []SessionEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SessionEvent(nil), e.events...)
+}
+
+func TestWebhookReceivesLifecycleEvents(t *testing.T) {
+	receiver := &eventReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	s := startServer(t, "-webhook-url", server.URL)
+	session := s.create(t, `{"name":"hooked"}`)
+	s.close(t, session.Id)
+
+	eventually(t, 5*time.Second, func() bool { return len(receiver.received()) == 2 })
+	events := receiver.received()
+	if events[0].Type != EventCreated || events[0].Id != session.Id || events[0].Name != "hooked" || events[1].Type != EventClosed {
+		t.Errorf("got %+v", events)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	receiver := &eventReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhook := NewWebhook(server.URL, 2, time.Second)
+	webhook.Notify(SessionEvent{Type: EventCreated, Name: "retried"})
+
+	eventually(t, 5*time.Second, func() bool { return len(receiver.received()) == 1 })
+}